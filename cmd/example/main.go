@@ -10,13 +10,14 @@ import (
 	"github.com/ydb-platform/ydb-go-sdk/v3/table"
 	"github.com/ydb-platform/ydb-go-sdk/v3/table/result/named"
 	"log"
+	"log/slog"
 	"os"
 	"os/signal"
 	"time"
 )
 
 func DoSomeUserStuff(ctx context.Context, s table.Session, txr table.Transaction) error {
-	txr, res, err := s.Execute(ctx, table.TxControl(table.WithTx(txr)), "select * from locks", nil)
+	_, res, err := s.Execute(ctx, table.TxControl(table.WithTx(txr)), "select * from locks", nil)
 	if err != nil {
 		return fmt.Errorf("execute error: %w", err)
 	}
@@ -35,12 +36,7 @@ func DoSomeUserStuff(ctx context.Context, s table.Session, txr table.Transaction
 			fmt.Println("lock_name:", lock_name, "owner:", owner, "timeout:", deadline)
 		}
 	}
-	r, err := txr.CommitTx(ctx)
-	defer r.Close()
 	time.Sleep(time.Second * 1)
-	if err != nil {
-		return err
-	}
 	return nil
 }
 
@@ -87,14 +83,18 @@ func main() {
 		log.Fatal("create table error", err)
 		return
 	}
-	storage := ydb_locker.YdbLockStorage{Db: db, ReqBuilder: reqBuilder}
+	storage := ydb_locker.YdbLockStorage{Db: db, ReqBuilder: reqBuilder, Logger: slog.Default()}
 	locker := ydb_locker.NewLocker(&storage, "lock1", "owner1", time.Second*10)
+	locker.Logger = slog.Default()
+	locker.OnError = func(err error) {
+		log.Println("locker error:", err)
+	}
 
 	for lockCtx := range locker.LockerContext(ctx) {
 		for lockCtx.Err() == nil {
 			err = locker.ExecuteUnderLock(lockCtx, func(ctx context.Context, ts table.Session, txr table.Transaction) error {
 				return DoSomeUserStuff(ctx, ts, txr)
-			})
+			}, ydb_locker.WithAutoCommit())
 
 			if err != nil {
 				log.Fatal("lock error", err)
@@ -102,5 +102,8 @@ func main() {
 			}
 		}
 	}
+	if err := locker.Err(); err != nil {
+		log.Fatal("locker stopped", err)
+	}
 
 }
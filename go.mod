@@ -2,13 +2,15 @@ module github.com/robdrynkin/ydb_locker
 
 go 1.22.0
 
+require (
+	github.com/google/uuid v1.6.0
+	github.com/jonboulle/clockwork v0.4.0
+	github.com/ydb-platform/ydb-go-genproto v0.0.0-20240528144234-5d5a685e41f7
+	github.com/ydb-platform/ydb-go-sdk/v3 v3.76.4
+)
+
 require (
 	github.com/golang-jwt/jwt/v4 v4.5.0 // indirect
-	github.com/golang/protobuf v1.5.4 // indirect
-	github.com/google/uuid v1.6.0 // indirect
-	github.com/jonboulle/clockwork v0.4.0 // indirect
-	github.com/ydb-platform/ydb-go-genproto v0.0.0-20240528144234-5d5a685e41f7 // indirect
-	github.com/ydb-platform/ydb-go-sdk/v3 v3.76.4 // indirect
 	golang.org/x/net v0.28.0 // indirect
 	golang.org/x/sync v0.8.0 // indirect
 	golang.org/x/sys v0.24.0 // indirect
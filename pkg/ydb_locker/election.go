@@ -0,0 +1,154 @@
+package ydb_locker
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoLeader           = errors.New("election: no leader")
+	ErrAlreadyCampaigning = errors.New("election: already campaigning")
+)
+
+// Election is a leader election on top of a single lock row, modelled after etcd's concurrency.Election:
+// the leader is the current owner of LockName with a live lease.
+type Election struct {
+	// Locker does the campaigning, set its Logger, Metrics or OnError to observe it.
+	Locker *Locker
+	// ObserveInterval is how often Observe polls the storage, Ttl/10 if zero.
+	ObserveInterval time.Duration
+
+	mu      sync.Mutex
+	resign  context.CancelFunc
+	stopped chan struct{}
+}
+
+func NewElection(lockStorage LockStorage, lockName string, ownerName string, ttl time.Duration, opts ...LockerOption) *Election {
+	return &Election{
+		Locker: NewLocker(lockStorage, lockName, ownerName, ttl, opts...),
+	}
+}
+
+// Campaign blocks until this owner becomes the leader or ctx is done. The returned context is cancelled
+// when leadership is lost or resigned; after that Campaign may be called again.
+func (e *Election) Campaign(ctx context.Context) (context.Context, error) {
+	e.mu.Lock()
+	if e.resign != nil {
+		e.mu.Unlock()
+		return nil, ErrAlreadyCampaigning
+	}
+	campaignCtx, resign := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	e.resign, e.stopped = resign, stopped
+	e.mu.Unlock()
+
+	lockCtxs := e.Locker.LockerContext(campaignCtx)
+	stop := func() {
+		resign()
+		for range lockCtxs {
+		}
+		e.mu.Lock()
+		if e.stopped == stopped {
+			e.resign, e.stopped = nil, nil
+		}
+		e.mu.Unlock()
+		close(stopped)
+	}
+
+	select {
+	case leaderCtx, ok := <-lockCtxs:
+		if !ok {
+			stop()
+			return nil, e.Locker.Err()
+		}
+		go func() {
+			<-leaderCtx.Done()
+			stop()
+		}()
+		return leaderCtx, nil
+
+	case <-ctx.Done():
+		stop()
+		return nil, ctx.Err()
+	}
+}
+
+// Resign gives up leadership (or the running campaign) and waits until the lock is released.
+func (e *Election) Resign(ctx context.Context) error {
+	e.mu.Lock()
+	resign, stopped := e.resign, e.stopped
+	e.mu.Unlock()
+	if resign == nil {
+		return nil
+	}
+
+	resign()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Leader returns the current leader, ErrNoLeader if nobody holds a live lease by the storage clock.
+func (e *Election) Leader(ctx context.Context) (LockInfo, error) {
+	info, err := e.Locker.LockStorage.GetLock(ctx, e.Locker.LockName)
+	if errors.Is(err, ErrLockNotFound) {
+		return LockInfo{}, ErrNoLeader
+	}
+	if err != nil {
+		return LockInfo{}, err
+	}
+	if !info.HasLeader() {
+		return LockInfo{}, ErrNoLeader
+	}
+	return info, nil
+}
+
+// Observe streams leader changes: the current state first, then every change of the leader, its generation or metadata.
+// An empty Owner means there is no leader, liveness is decided by the storage clock as in Leader. The channel is closed when ctx is done.
+func (e *Election) Observe(ctx context.Context) <-chan LockInfo {
+	leaders := make(chan LockInfo)
+	clock := e.Locker.opts().clock
+	interval := e.ObserveInterval
+	if interval <= 0 {
+		interval = e.Locker.Ttl / 10
+	}
+
+	go func() {
+		defer close(leaders)
+		var last *LockInfo
+		for {
+			info, err := e.Locker.LockStorage.GetLock(ctx, e.Locker.LockName)
+			if err != nil {
+				if e.Locker.OnError != nil && ctx.Err() == nil {
+					e.Locker.OnError(err)
+				}
+			} else {
+				if !info.HasLeader() {
+					info = LockInfo{LockName: info.LockName}
+				}
+				if last == nil || last.Owner != info.Owner || last.Generation != info.Generation || !bytes.Equal(last.Metadata, info.Metadata) {
+					select {
+					case leaders <- info:
+					case <-ctx.Done():
+						return
+					}
+					last = &info
+				}
+			}
+
+			select {
+			case <-clock.After(interval):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return leaders
+}
@@ -0,0 +1,84 @@
+package ydb_locker
+
+import (
+	"context"
+	"errors"
+	"github.com/jonboulle/clockwork"
+	"testing"
+	"time"
+)
+
+func TestLocalElection(t *testing.T) {
+	ctx := context.Background()
+	storage := NewLocalLockStorage()
+	e1 := NewElection(storage, "election1", "candidate1", time.Millisecond*100)
+	e2 := NewElection(storage, "election1", "candidate2", time.Millisecond*100)
+
+	leaderCtx, err := e1.Campaign(ctx)
+	if err != nil {
+		t.Fatal("campaign error", err)
+	}
+	if leader, err := e2.Leader(ctx); err != nil || leader.Owner != "candidate1" {
+		t.Errorf("expected candidate1 to lead, got %v %v", leader.Owner, err)
+	}
+
+	observeCtx, stopObserving := context.WithCancel(ctx)
+	defer stopObserving()
+	leaders := e2.Observe(observeCtx)
+	if leader := <-leaders; leader.Owner != "candidate1" {
+		t.Errorf("expected to observe candidate1, got %q", leader.Owner)
+	}
+
+	ctx200ms, cancel := context.WithTimeout(ctx, time.Millisecond*200)
+	defer cancel()
+	if _, err := e2.Campaign(ctx200ms); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected campaign to time out, got %v", err)
+	}
+
+	if err := e1.Resign(ctx); err != nil {
+		t.Fatal("resign error", err)
+	}
+	if leaderCtx.Err() == nil {
+		t.Error("leadership context is alive after resign")
+	}
+	if _, err := e2.Leader(ctx); !errors.Is(err, ErrNoLeader) {
+		t.Errorf("expected no leader after resign, got %v", err)
+	}
+
+	leaderCtx, err = e2.Campaign(ctx)
+	if err != nil {
+		t.Fatal("campaign error", err)
+	}
+	for leader := range leaders {
+		if leader.Owner == "candidate2" {
+			break
+		}
+	}
+	e2.Resign(ctx)
+	<-leaderCtx.Done()
+}
+
+func TestLocalElectionLeaderIgnoresObserverClock(t *testing.T) {
+	ctx := context.Background()
+	storage := NewLocalLockStorage()
+	candidate := NewElection(storage, "election1", "candidate1", time.Second*10)
+	// The observer clock is an hour ahead of the storage, the lease is still live by the storage clock.
+	observer := NewElection(storage, "election1", "observer", time.Second*10, WithClock(clockwork.NewFakeClockAt(time.Now().Add(time.Hour))))
+
+	leaderCtx, err := candidate.Campaign(ctx)
+	if err != nil {
+		t.Fatal("campaign error", err)
+	}
+	if leader, err := observer.Leader(ctx); err != nil || leader.Owner != "candidate1" {
+		t.Errorf("expected candidate1 to lead, got %q %v", leader.Owner, err)
+	}
+
+	observeCtx, stopObserving := context.WithCancel(ctx)
+	defer stopObserving()
+	if leader := <-observer.Observe(observeCtx); leader.Owner != "candidate1" {
+		t.Errorf("expected to observe candidate1, got %q", leader.Owner)
+	}
+
+	candidate.Resign(ctx)
+	<-leaderCtx.Done()
+}
@@ -0,0 +1,63 @@
+package ydb_locker
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+)
+
+// Cancellation causes of lease contexts, see context.Cause.
+var (
+	// ErrLeaseExpired means the lease deadline passed without a successful renewal.
+	ErrLeaseExpired = errors.New("lock lease expired")
+	// ErrLockerStopped means the context the locker was started with is done, it wraps that context's cause.
+	ErrLockerStopped = errors.New("locker stopped")
+	// ErrStorageUnavailable means the lease expired while the storage was failing renewal requests.
+	ErrStorageUnavailable = errors.New("lock storage unavailable")
+	// ErrLockStolen means the lock was observed held by another owner.
+	ErrLockStolen = errors.New("lock is held by another owner")
+	// ErrLeaseReleased means the lease was given up with Lease.Release.
+	ErrLeaseReleased = errors.New("lock lease released")
+)
+
+// Errors returned by LockStorage implementations and the YDB request helpers.
+var (
+	// ErrLockNotFound means there is no row for the lock, CreateLock was not called for it.
+	ErrLockNotFound = errors.New("lock not found")
+	// ErrNotOwner means the lock is held by another owner.
+	ErrNotOwner = errors.New("not lock owner")
+	// ErrLockExpired means the caller is still recorded as the owner but its lease deadline has passed.
+	ErrLockExpired = errors.New("lock lease has expired")
+	// ErrTableMissing means the locks table or one of its columns does not exist, see CreateLocksTable.
+	ErrTableMissing = errors.New("locks table is missing")
+	// ErrNoMetadataColumn means the request builder has no metadata column configured.
+	ErrNoMetadataColumn = errors.New("locks table has no metadata column")
+	// ErrLockGuard means a guarded query was aborted because the caller does not hold a live lease of the lock,
+	// see LockRequestBuilder.GetGuardedQueryWithParams.
+	ErrLockGuard = errors.New("lock guard failed: not the lock holder")
+	// ErrUnexpectedResult means a query returned a result of a shape it never should, e.g. no rows.
+	ErrUnexpectedResult = errors.New("unexpected query result")
+)
+
+// ErrLockBusy is returned by Locker.TryAcquire when the lock is held by another owner.
+var ErrLockBusy = errors.New("lock is busy")
+
+// PanicError is the error of a function run under the lock that panicked, Stack is where it happened.
+type PanicError struct {
+	Value any
+	Stack []byte
+}
+
+func newPanicError(value any) *PanicError {
+	return &PanicError{Value: value, Stack: debug.Stack()}
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic under lock: %v", e.Value)
+}
+
+// Unwrap returns the panic value if it is an error.
+func (e *PanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
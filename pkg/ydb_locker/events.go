@@ -0,0 +1,88 @@
+package ydb_locker
+
+import (
+	"context"
+	"time"
+)
+
+type LockEventType int
+
+const (
+	// EventAcquired: the owner took the lock, Deadline and Generation describe the new lease.
+	EventAcquired LockEventType = iota
+	// EventRenewed: the owner prolonged its lease up to Deadline.
+	EventRenewed
+	// EventLostToOwner: storage reports another Owner holding the lock.
+	EventLostToOwner
+	// EventExpired: the lease deadline passed before it was renewed.
+	EventExpired
+	// EventStorageError: a storage request made by the locker loop failed with Err.
+	EventStorageError
+	// EventReleased: the owner released the lock on shutdown.
+	EventReleased
+)
+
+func (t LockEventType) String() string {
+	switch t {
+	case EventAcquired:
+		return "Acquired"
+	case EventRenewed:
+		return "Renewed"
+	case EventLostToOwner:
+		return "LostToOwner"
+	case EventExpired:
+		return "Expired"
+	case EventStorageError:
+		return "StorageError"
+	case EventReleased:
+		return "Released"
+	}
+	return "Unknown"
+}
+
+type LockEvent struct {
+	Type     LockEventType
+	LockName string
+	// Owner is the lock owner as seen by the event: this locker for Acquired/Renewed/Expired/Released,
+	// the new owner for LostToOwner, empty for StorageError.
+	Owner      string
+	Deadline   time.Time
+	Generation uint64
+	Err        error
+	Timestamp  time.Time
+}
+
+// Subscribe returns a channel of lock lifecycle events produced by LockerContext runs of this locker.
+// The channel is closed when ctx is done. Events are dropped for subscribers that do not keep up,
+// so the renewal loop is never blocked by them.
+func (l *Locker) Subscribe(ctx context.Context) <-chan LockEvent {
+	events := make(chan LockEvent, l.opts().eventBufferSize)
+
+	l.subsMu.Lock()
+	if l.subs == nil {
+		l.subs = make(map[chan LockEvent]struct{})
+	}
+	l.subs[events] = struct{}{}
+	l.subsMu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		l.subsMu.Lock()
+		delete(l.subs, events)
+		close(events)
+		l.subsMu.Unlock()
+	}()
+
+	return events
+}
+
+func (l *Locker) publish(event LockEvent) {
+	l.subsMu.Lock()
+	defer l.subsMu.Unlock()
+	for sub := range l.subs {
+		select {
+		case sub <- event:
+		default:
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package ydb_locker
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLocalLockerEvents(t *testing.T) {
+	ctx := context.Background()
+	storage := NewLocalLockStorage()
+	locker := NewLocker(storage, "lock1", "owner1", time.Millisecond*100)
+
+	subCtx, unsubscribe := context.WithCancel(ctx)
+	defer unsubscribe()
+	events := locker.Subscribe(subCtx)
+
+	lockerCtx, cancel := context.WithCancel(ctx)
+	lockCtxs := locker.LockerContext(lockerCtx)
+	<-lockCtxs
+
+	expectEvent := func(expected LockEventType) LockEvent {
+		t.Helper()
+		for {
+			select {
+			case event := <-events:
+				if event.Type == EventRenewed && expected != EventRenewed {
+					continue
+				}
+				if event.Type == EventExpired {
+					t.Fatalf("unexpected %s event", event.Type)
+				}
+				if event.Type != expected {
+					t.Fatalf("expected %s event, got %s", expected, event.Type)
+				}
+				return event
+			case <-time.After(time.Second):
+				t.Fatalf("no %s event", expected)
+			}
+		}
+	}
+
+	acquired := expectEvent(EventAcquired)
+	if acquired.Owner != "owner1" || acquired.Generation != 1 || acquired.Deadline.IsZero() {
+		t.Errorf("unexpected acquired event: %+v", acquired)
+	}
+	expectEvent(EventRenewed)
+
+	storage.Mu.Lock()
+	storage.Locks["lock1"].OwnerName = "admin"
+	storage.Locks["lock1"].Deadline = time.Now().Add(time.Millisecond * 200)
+	storage.Mu.Unlock()
+
+	if lost := expectEvent(EventLostToOwner); lost.Owner != "admin" {
+		t.Errorf("expected lock lost to admin, got %+v", lost)
+	}
+	if reacquired := expectEvent(EventAcquired); reacquired.Generation != 2 {
+		t.Errorf("expected generation 2 after takeover, got %d", reacquired.Generation)
+	}
+
+	cancel()
+	for range lockCtxs {
+	}
+	expectEvent(EventReleased)
+}
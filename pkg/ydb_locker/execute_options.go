@@ -0,0 +1,107 @@
+package ydb_locker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table"
+)
+
+// TxMode is the mode of the transaction ExecuteUnderLock checks the lease in and hands to the function.
+type TxMode int
+
+const (
+	// TxSerializableReadWrite is the default: the writes of the function commit only if the lease was held.
+	TxSerializableReadWrite TxMode = iota
+	// TxSnapshotReadOnly gives the function a read-only transaction over the snapshot the lease was checked in.
+	TxSnapshotReadOnly
+	// TxOnlineReadOnly checks the lease in a transaction of its own, online read-only transactions can not span
+	// several queries. The function gets a nil transaction and runs its reads with table.OnlineReadOnlyTxControl.
+	TxOnlineReadOnly
+)
+
+func (m TxMode) String() string {
+	switch m {
+	case TxSerializableReadWrite:
+		return "serializable_read_write"
+	case TxSnapshotReadOnly:
+		return "snapshot_read_only"
+	case TxOnlineReadOnly:
+		return "online_read_only"
+	default:
+		return "unknown"
+	}
+}
+
+// txControl returns the control of the lease check query, it begins the transaction passed to the function
+// unless the mode is not interactive.
+func (m TxMode) txControl() *table.TransactionControl {
+	switch m {
+	case TxSnapshotReadOnly:
+		return table.TxControl(table.BeginTx(table.WithSnapshotReadOnly()))
+	case TxOnlineReadOnly:
+		return table.OnlineReadOnlyTxControl()
+	default:
+		return table.TxControl(table.BeginTx(table.WithSerializableReadWrite()))
+	}
+}
+
+func (m TxMode) interactive() bool {
+	return m != TxOnlineReadOnly
+}
+
+type executeOptions struct {
+	txMode     TxMode
+	autoCommit bool
+	idempotent bool
+}
+
+// ExecuteOption configures a single ExecuteUnderLock call.
+type ExecuteOption func(*executeOptions)
+
+func newExecuteOptions(opts ...ExecuteOption) *executeOptions {
+	o := &executeOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithTxMode sets the mode of the transaction the function runs in, TxSerializableReadWrite by default.
+func WithTxMode(mode TxMode) ExecuteOption {
+	return func(o *executeOptions) {
+		o.txMode = mode
+	}
+}
+
+// WithAutoCommit commits the transaction when the function returns nil and rolls it back when it fails,
+// the function must not commit it itself then. By default the transaction is left to the function.
+func WithAutoCommit() ExecuteOption {
+	return func(o *executeOptions) {
+		o.autoCommit = true
+	}
+}
+
+// WithIdempotent marks the function safe to run more than once: the whole call, lease check included,
+// is retried when the transaction is aborted, e.g. on transaction locks invalidated.
+// Aborts of other functions are returned to the caller.
+func WithIdempotent() ExecuteOption {
+	return func(o *executeOptions) {
+		o.idempotent = true
+	}
+}
+
+// finishTx commits tx if the function succeeded and rolls it back otherwise.
+func finishTx(ctx context.Context, tx table.Transaction, err error) error {
+	if err != nil {
+		if rollbackErr := tx.Rollback(ctx); rollbackErr != nil {
+			return errors.Join(err, fmt.Errorf("rollback error: %w", rollbackErr))
+		}
+		return err
+	}
+	res, err := tx.CommitTx(ctx)
+	if err != nil {
+		return fmt.Errorf("commit error: %w", err)
+	}
+	return res.Close()
+}
@@ -0,0 +1,273 @@
+package ydb_locker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// LeaseInfo describes the lease a context was handed out for.
+type LeaseInfo struct {
+	LockName string
+	Owner    string
+	// Deadline is the lease deadline at the moment LeaseFromContext was called.
+	Deadline time.Time
+	// Generation is the fencing token of the lease, see FencingTokenFromContext.
+	Generation uint64
+}
+
+type leaseKey struct{}
+
+// leaseContext is the context yielded by LockerContext. Its deadline follows the lease:
+// every successful renewal moves it forward.
+type leaseContext struct {
+	context.Context
+	lockName   string
+	owner      string
+	generation uint64
+	deadline   *atomic.Int64
+	margin     time.Duration
+}
+
+// Deadline returns the current lease deadline, less the safety margin. Contexts derived with WithDeadline or WithTimeout
+// capture it once, so derive them right before the call they bound rather than once per lease.
+func (c *leaseContext) Deadline() (time.Time, bool) {
+	return time.Unix(0, c.deadline.Load()).Add(-c.margin), true
+}
+
+func (c *leaseContext) Value(key any) any {
+	if key == (leaseKey{}) {
+		return c
+	}
+	return c.Context.Value(key)
+}
+
+// LeaseFromContext returns the lease a context from LockerContext, or any context derived from it, was handed out for.
+func LeaseFromContext(ctx context.Context) (LeaseInfo, bool) {
+	c, ok := ctx.Value(leaseKey{}).(*leaseContext)
+	if !ok {
+		return LeaseInfo{}, false
+	}
+	deadline, _ := c.Deadline()
+	return LeaseInfo{LockName: c.lockName, Owner: c.owner, Deadline: deadline, Generation: c.generation}, true
+}
+
+// leaseGeneration returns the generation of the lease ctx was handed out for if it is a lease of lockName held by owner, 0 otherwise.
+func leaseGeneration(ctx context.Context, lockName string, owner string) uint64 {
+	lease, ok := LeaseFromContext(ctx)
+	if !ok || lease.LockName != lockName || lease.Owner != owner {
+		return 0
+	}
+	return lease.Generation
+}
+
+// Lease is a single acquisition of the lock made by Locker.Acquire or Locker.TryAcquire.
+// It is renewed in the background until it is released or lost.
+type Lease struct {
+	locker     *Locker
+	options    *lockerOptions
+	ctx        *leaseContext
+	cancel     context.CancelCauseFunc
+	deadline   atomic.Int64
+	ended      atomic.Bool
+	renewFails atomic.Bool
+
+	stopRenew context.CancelFunc
+	renewDone chan struct{}
+}
+
+// Context returns the lease context, it is cancelled with the cause of the lease end, see ErrLeaseExpired and friends.
+func (l *Lease) Context() context.Context {
+	return l.ctx
+}
+
+// Deadline returns the current lease deadline less the safety margin, renewals move it forward.
+func (l *Lease) Deadline() time.Time {
+	deadline, _ := l.ctx.Deadline()
+	return deadline
+}
+
+// Done is closed once the lease is over.
+func (l *Lease) Done() <-chan struct{} {
+	return l.ctx.Done()
+}
+
+// Generation returns the fencing token of the lease.
+func (l *Lease) Generation() uint64 {
+	return l.ctx.generation
+}
+
+// end cancels the lease context with the given cause, only the first call has an effect.
+func (l *Lease) end(cause error) {
+	if !l.ended.CompareAndSwap(false, true) {
+		return
+	}
+	l.cancel(cause)
+	metrics := metricsOrNop(l.locker.Metrics)
+	metrics.LockLost(l.locker.LockName)
+	metrics.SetLeader(l.locker.LockName, false)
+}
+
+// Renew extends the lease right away, the background renewal does the same periodically.
+// A lease that is already over is not renewed, the cause of its end is returned instead.
+func (l *Lease) Renew(ctx context.Context) error {
+	if l.ended.Load() {
+		return context.Cause(l.ctx)
+	}
+	lk := l.locker
+	timeout := l.options.renewTimeout(lk.Ttl, time.Unix(0, l.deadline.Load()), true)
+	event, _, err := attemptLock(ctx, lk.LockStorage, lk.LockName, lk.OwnerName, lk.Ttl, metricsOrNop(lk.Metrics), l.options.clock, timeout)
+	if err != nil {
+		l.renewFails.Store(true)
+		lk.publish(LockEvent{Type: EventStorageError, LockName: lk.LockName, Err: err, Timestamp: l.options.clock.Now()})
+		return fmt.Errorf("renew lock %s: %w", lk.LockName, err)
+	}
+	if event.Owner != lk.OwnerName {
+		err := fmt.Errorf("%w: %s", ErrLockStolen, event.Owner)
+		l.end(err)
+		event.Type = EventLostToOwner
+		lk.publish(event)
+		return err
+	}
+	if event.Generation != l.ctx.generation {
+		// The lock was held by somebody else in between, the renewal is a new lease that this one must not extend.
+		err := fmt.Errorf("%w: generation %d replaced by %d", ErrLockStolen, l.ctx.generation, event.Generation)
+		l.end(err)
+		lk.publish(LockEvent{Type: EventExpired, LockName: lk.LockName, Owner: lk.OwnerName, Deadline: time.Unix(0, l.deadline.Load()), Generation: l.ctx.generation, Timestamp: l.options.clock.Now()})
+		return err
+	}
+	if l.ended.Load() {
+		return context.Cause(l.ctx)
+	}
+	l.deadline.Store(event.Deadline.UnixNano())
+	l.renewFails.Store(false)
+	event.Type = EventRenewed
+	lk.publish(event)
+	return nil
+}
+
+// Release stops the renewal and gives the lock up so that other owners do not wait for the deadline.
+func (l *Lease) Release(ctx context.Context) error {
+	l.stopRenew()
+	<-l.renewDone
+	l.end(ErrLeaseReleased)
+
+	lk := l.locker
+	released, err := lk.LockStorage.Release(ctx, lk.LockName, lk.OwnerName)
+	if err != nil {
+		return fmt.Errorf("release lock %s: %w", lk.LockName, err)
+	}
+	if released {
+		lk.publish(LockEvent{Type: EventReleased, LockName: lk.LockName, Owner: lk.OwnerName, Timestamp: l.options.clock.Now()})
+	}
+	return nil
+}
+
+func (l *Lease) renewLoop(ctx context.Context) {
+	defer close(l.renewDone)
+	clock := l.options.clock
+	renewTimer := clock.NewTimer(l.options.renewDelay(l.locker.Ttl))
+	defer renewTimer.Stop()
+	expireTimer := clock.NewTimer(l.Deadline().Sub(clock.Now()))
+	defer expireTimer.Stop()
+	for {
+		select {
+		case <-renewTimer.Chan():
+			if err := l.Renew(ctx); err != nil {
+				if l.ended.Load() {
+					return
+				}
+				if l.locker.OnError != nil {
+					l.locker.OnError(err)
+				}
+			}
+			renewTimer.Reset(l.options.renewDelay(l.locker.Ttl))
+
+		case <-expireTimer.Chan():
+			if now := clock.Now(); now.Before(l.Deadline()) {
+				expireTimer.Reset(l.Deadline().Sub(now))
+				continue
+			}
+			if l.renewFails.Load() {
+				l.end(ErrStorageUnavailable)
+			} else {
+				l.end(ErrLeaseExpired)
+			}
+			l.locker.publish(LockEvent{Type: EventExpired, LockName: l.locker.LockName, Owner: l.locker.OwnerName, Deadline: time.Unix(0, l.deadline.Load()), Timestamp: clock.Now()})
+			return
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// TryAcquire makes a single attempt to take the lock, ErrLockBusy is returned if another owner holds it.
+// ctx only bounds the attempt: the lease lives until it is released or lost.
+func (l *Locker) TryAcquire(ctx context.Context) (*Lease, error) {
+	if _, err := l.LockStorage.CreateLock(ctx, l.LockName); err != nil {
+		return nil, fmt.Errorf("create lock %s: %w", l.LockName, err)
+	}
+	return l.tryAcquire(ctx)
+}
+
+// Acquire blocks until the lock is taken or ctx is done, polling the storage with exponential backoff,
+// see WithAcquireBackoff, or at the interval set with WithAcquirePollInterval.
+// Storage errors are passed to OnError and retried. ctx only bounds the wait, see TryAcquire.
+func (l *Locker) Acquire(ctx context.Context) (*Lease, error) {
+	o := l.opts()
+	if _, err := createLockWithRetries(ctx, l.LockStorage, l.LockName, l.OnError, loggerOrNop(l.Logger), o); err != nil {
+		return nil, err
+	}
+	delay := o.acquireBackoff.initial
+	for {
+		lease, err := l.tryAcquire(ctx)
+		if err == nil {
+			return lease, nil
+		}
+		if !errors.Is(err, ErrLockBusy) && l.OnError != nil {
+			l.OnError(err)
+		}
+		wait := delay
+		if o.pollInterval > 0 {
+			wait = o.pollDelay(l.Ttl)
+		}
+		select {
+		case <-o.clock.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		delay = o.acquireBackoff.next(delay)
+	}
+}
+
+func (l *Locker) tryAcquire(ctx context.Context) (*Lease, error) {
+	o := l.opts()
+	metrics := metricsOrNop(l.Metrics)
+	event, latency, err := attemptLock(ctx, l.LockStorage, l.LockName, l.OwnerName, l.Ttl, metrics, o.clock, o.renewTimeout(l.Ttl, time.Time{}, false))
+	if err != nil {
+		return nil, fmt.Errorf("try lock %s: %w", l.LockName, err)
+	}
+	if event.Owner != l.OwnerName {
+		return nil, fmt.Errorf("%w: held by %s", ErrLockBusy, event.Owner)
+	}
+	loggerOrNop(l.Logger).Info("lock acquired", "lock", l.LockName, "owner", l.OwnerName, "deadline", event.Deadline, "generation", event.Generation, "latency", latency)
+	setLockMetadata(ctx, l.LockStorage, l.LockName, l.OwnerName, l.getMetadata, l.OnError, loggerOrNop(l.Logger), o.renewInterval(l.Ttl))
+
+	lease := &Lease{locker: l, options: o, renewDone: make(chan struct{})}
+	lease.deadline.Store(event.Deadline.UnixNano())
+	cancelCtx, cancel := context.WithCancelCause(context.WithoutCancel(ctx))
+	lease.ctx = &leaseContext{Context: cancelCtx, lockName: l.LockName, owner: l.OwnerName, generation: event.Generation, deadline: &lease.deadline, margin: o.safetyMargin}
+	lease.cancel = cancel
+	renewCtx, stopRenew := context.WithCancel(context.WithoutCancel(ctx))
+	lease.stopRenew = stopRenew
+	metrics.LockAcquired(l.LockName)
+	metrics.SetLeader(l.LockName, true)
+	event.Type = EventAcquired
+	l.publish(event)
+
+	go lease.renewLoop(renewCtx)
+	return lease, nil
+}
@@ -0,0 +1,119 @@
+package ydb_locker
+
+import (
+	"context"
+	"errors"
+	"github.com/jonboulle/clockwork"
+	"testing"
+	"time"
+)
+
+func TestLocalLockerAcquire(t *testing.T) {
+	ctx := context.Background()
+	storage := NewLocalLockStorage()
+	locker1 := NewLocker(storage, "lock1", "owner1", time.Second)
+	locker2 := NewLocker(storage, "lock1", "owner2", time.Second)
+
+	lease, err := locker1.TryAcquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease.Generation() != 1 {
+		t.Errorf("expected generation 1, got %d", lease.Generation())
+	}
+	if _, err := locker2.TryAcquire(ctx); !errors.Is(err, ErrLockBusy) {
+		t.Fatalf("expected ErrLockBusy, got %v", err)
+	}
+
+	deadline := lease.Deadline()
+	time.Sleep(time.Millisecond * 10)
+	if err := lease.Renew(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !lease.Deadline().After(deadline) {
+		t.Errorf("deadline was not moved by Renew: %v, before %v", lease.Deadline(), deadline)
+	}
+
+	// The background renewal keeps the lease alive past its ttl.
+	time.Sleep(time.Millisecond * 1500)
+	if lease.Context().Err() != nil {
+		t.Fatal("lease is over while it is renewed:", context.Cause(lease.Context()))
+	}
+
+	acquired := make(chan *Lease, 1)
+	go func() {
+		ctx5s, cancel := context.WithTimeout(ctx, time.Second*5)
+		defer cancel()
+		lease2, err := locker2.Acquire(ctx5s)
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- lease2
+	}()
+
+	if err := lease.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	<-lease.Done()
+	if !errors.Is(context.Cause(lease.Context()), ErrLeaseReleased) {
+		t.Errorf("expected ErrLeaseReleased cause, got %v", context.Cause(lease.Context()))
+	}
+	if err := lease.Renew(ctx); !errors.Is(err, ErrLeaseReleased) {
+		t.Errorf("expected released lease not to renew, got %v", err)
+	}
+
+	lease2 := <-acquired
+	if lease2 == nil {
+		t.Fatal("lock was not acquired by the second owner")
+	}
+	if lease2.Generation() != 2 {
+		t.Errorf("expected generation 2, got %d", lease2.Generation())
+	}
+	if err := lease2.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLocalLockerAcquireCancelled(t *testing.T) {
+	ctx := context.Background()
+	storage := NewLocalLockStorage()
+	lease, err := NewLocker(storage, "lock1", "owner1", time.Second*10).TryAcquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lease.Release(ctx)
+
+	ctx100ms, cancel := context.WithTimeout(ctx, time.Millisecond*100)
+	defer cancel()
+	if _, err := NewLocker(storage, "lock1", "owner2", time.Second*10).Acquire(ctx100ms); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestLocalLeaseRenewGenerationChanged(t *testing.T) {
+	ctx := context.Background()
+	clock := clockwork.NewFakeClock()
+	storage := NewLocalLockStorage()
+	storage.Clock = clock
+	lease, err := NewLocker(storage, "lock1", "owner1", time.Second*10, WithClock(clock)).TryAcquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lease.Release(ctx)
+
+	// The lock went through other holders back to owner1 behind the lease's back.
+	storage.Mu.Lock()
+	storage.Locks["lock1"].Generation = 3
+	storage.Mu.Unlock()
+
+	if err := lease.Renew(ctx); !errors.Is(err, ErrLockStolen) {
+		t.Errorf("expected ErrLockStolen, got %v", err)
+	}
+	<-lease.Done()
+	if lease.Generation() != 1 {
+		t.Errorf("expected the lease to keep generation 1, got %d", lease.Generation())
+	}
+	if !errors.Is(context.Cause(lease.Context()), ErrLockStolen) {
+		t.Errorf("expected ErrLockStolen cause, got %v", context.Cause(lease.Context()))
+	}
+}
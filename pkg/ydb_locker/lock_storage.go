@@ -1,64 +1,195 @@
 package ydb_locker
 
 import (
+	"bytes"
 	"context"
-	"errors"
+	"fmt"
+	"github.com/jonboulle/clockwork"
 	"github.com/ydb-platform/ydb-go-sdk/v3"
 	"github.com/ydb-platform/ydb-go-sdk/v3/table"
+	"log/slog"
 	"sync"
 	"time"
 )
 
+// LockInfo is the state of a lock row as seen by readers.
+type LockInfo struct {
+	LockName   string
+	Owner      string
+	Deadline   time.Time
+	Generation uint64
+	// Metadata is published by the owner via SetMetadata, it is cleared when the lock changes owner or is released.
+	Metadata []byte
+	// Alive reports whether the deadline had not passed by the storage clock when the lock was read.
+	// Unlike IsHeld it does not depend on the clock skew between the reader and the storage.
+	Alive bool
+}
+
+// IsHeld reports whether the lock has an owner whose lease has not expired by now.
+func (i LockInfo) IsHeld(now time.Time) bool {
+	return i.Owner != "" && i.Deadline.After(now)
+}
+
+// HasLeader reports whether the lock has an owner with a live lease by the storage clock, see Alive.
+func (i LockInfo) HasLeader() bool {
+	return i.Owner != "" && i.Alive
+}
+
 type LockStorage interface {
 	CreateLock(ctx context.Context, lockName string) (bool, error)
-	TryLock(ctx context.Context, lockName string, ownerName string, ttl time.Duration) (string, time.Time, error)
+	TryLock(ctx context.Context, lockName string, ownerName string, ttl time.Duration) (string, time.Time, uint64, error)
+	Release(ctx context.Context, lockName string, ownerName string) (bool, error)
+	GetLock(ctx context.Context, lockName string) (LockInfo, error)
+	SetMetadata(ctx context.Context, lockName string, ownerName string, metadata []byte) (bool, error)
 	CheckLockOwner(ctx context.Context, ts table.Session, lockName string, ownerName string) (bool, table.Transaction, error)
-	ExecuteUnderLock(ctx context.Context, lockName string, ownerName string, f func(ctx context.Context, ts table.Session, tx table.Transaction) error) error
+	ExecuteUnderLock(ctx context.Context, lockName string, ownerName string, f func(ctx context.Context, ts table.Session, tx table.Transaction) error, opts ...ExecuteOption) error
 }
 
+// YdbLockStorage measures request latencies by the wall clock on purpose: they are round trips to YDB,
+// which a fake clock of the locker does not drive.
 type YdbLockStorage struct {
 	Db         *ydb.Driver
 	ReqBuilder LockRequestBuilder
+	// Logger receives debug records for every storage request, nil means no logging.
+	Logger *slog.Logger
+	// Metrics receives latency and result of every storage request, nil means no metrics.
+	Metrics Metrics
+	// RetryPolicy configures the SDK retries of the lock requests, nil leaves the SDK defaults.
+	// ExecuteUnderLock and ExecuteGuarded are not affected by it, see WithIdempotent.
+	RetryPolicy *RetryPolicy
+}
+
+// retryOptions returns the table.Client.Do options of a lock request.
+func (s *YdbLockStorage) retryOptions() []table.Option {
+	if s.RetryPolicy == nil {
+		return nil
+	}
+	return s.RetryPolicy.tableOptions()
 }
 
 func (s *YdbLockStorage) CreateLock(ctx context.Context, lockName string) (bool, error) {
-	return CreateLock(ctx, s.Db.Table(), lockName, s.ReqBuilder)
+	start := time.Now()
+	created, err := CreateLock(ctx, s.Db.Table(), lockName, s.ReqBuilder, s.retryOptions()...)
+	metricsOrNop(s.Metrics).StorageRequest("create", lockName, time.Since(start), err)
+	loggerOrNop(s.Logger).Debug("ydb create lock", "lock", lockName, "created", created, "latency", time.Since(start),
+		"error", err, "error_class", ClassifyError(err))
+	return created, err
+}
+
+func (s *YdbLockStorage) TryLock(ctx context.Context, lockName string, ownerName string, ttl time.Duration) (string, time.Time, uint64, error) {
+	start := time.Now()
+	owner, deadline, generation, err := TryLock(ctx, s.Db.Table(), lockName, ownerName, ttl, s.ReqBuilder, s.retryOptions()...)
+	metricsOrNop(s.Metrics).StorageRequest("try_lock", lockName, time.Since(start), err)
+	loggerOrNop(s.Logger).Debug("ydb try lock", "lock", lockName, "owner", ownerName, "current_owner", owner,
+		"deadline", deadline, "generation", generation, "latency", time.Since(start), "error", err, "error_class", ClassifyError(err))
+	return owner, deadline, generation, err
 }
 
-func (s *YdbLockStorage) TryLock(ctx context.Context, lockName string, ownerName string, ttl time.Duration) (string, time.Time, error) {
-	return TryLock(ctx, s.Db.Table(), lockName, ownerName, ttl, s.ReqBuilder)
+func (s *YdbLockStorage) Release(ctx context.Context, lockName string, ownerName string) (bool, error) {
+	start := time.Now()
+	released, err := ReleaseLock(ctx, s.Db.Table(), lockName, ownerName, s.ReqBuilder, s.retryOptions()...)
+	metricsOrNop(s.Metrics).StorageRequest("release", lockName, time.Since(start), err)
+	loggerOrNop(s.Logger).Debug("ydb release lock", "lock", lockName, "owner", ownerName, "released", released, "latency", time.Since(start),
+		"error", err, "error_class", ClassifyError(err))
+	return released, err
+}
+
+func (s *YdbLockStorage) GetLock(ctx context.Context, lockName string) (LockInfo, error) {
+	start := time.Now()
+	info, err := GetLock(ctx, s.Db.Table(), lockName, s.ReqBuilder, s.retryOptions()...)
+	metricsOrNop(s.Metrics).StorageRequest("get", lockName, time.Since(start), err)
+	loggerOrNop(s.Logger).Debug("ydb get lock", "lock", lockName, "current_owner", info.Owner,
+		"deadline", info.Deadline, "generation", info.Generation, "latency", time.Since(start), "error", err, "error_class", ClassifyError(err))
+	return info, err
+}
+
+func (s *YdbLockStorage) SetMetadata(ctx context.Context, lockName string, ownerName string, metadata []byte) (bool, error) {
+	start := time.Now()
+	updated, err := SetLockMetadata(ctx, s.Db.Table(), lockName, ownerName, metadata, s.ReqBuilder, s.retryOptions()...)
+	metricsOrNop(s.Metrics).StorageRequest("set_metadata", lockName, time.Since(start), err)
+	loggerOrNop(s.Logger).Debug("ydb set lock metadata", "lock", lockName, "owner", ownerName, "updated", updated, "latency", time.Since(start),
+		"error", err, "error_class", ClassifyError(err))
+	return updated, err
 }
 
 func (s *YdbLockStorage) CheckLockOwner(ctx context.Context, ts table.Session, lockName string, ownerName string) (bool, table.Transaction, error) {
 	return CheckLockOwner(ctx, ts, lockName, ownerName, s.ReqBuilder)
 }
 
-func (s *YdbLockStorage) ExecuteUnderLock(ctx context.Context, lockName string, ownerName string, f func(ctx context.Context, ts table.Session, tx table.Transaction) error) error {
-	return s.Db.Table().Do(ctx, func(ctx context.Context, ts table.Session) error {
-		ok, tx, err := s.CheckLockOwner(ctx, ts, lockName, ownerName)
+// ExecuteUnderLock runs f in the transaction that checked the lease, see CheckLease and ExecuteOption. If ctx carries
+// a lease of this lock, e.g. it was derived from a LockerContext one, its generation is checked as well.
+func (s *YdbLockStorage) ExecuteUnderLock(ctx context.Context, lockName string, ownerName string, f func(ctx context.Context, ts table.Session, tx table.Transaction) error, opts ...ExecuteOption) error {
+	o := newExecuteOptions(opts...)
+	generation := leaseGeneration(ctx, lockName, ownerName)
+	var doOpts []table.Option
+	if o.idempotent {
+		doOpts = append(doOpts, table.WithIdempotent())
+	}
+	// The SDK retries aborted transactions, an abort after f ran is returned as is unless f is idempotent.
+	var aborted error
+	err := s.Db.Table().Do(ctx, func(ctx context.Context, ts table.Session) error {
+		tx, err := checkLease(ctx, ts, o.txMode, lockName, ownerName, generation, s.ReqBuilder)
 		if err != nil {
 			return err
 		}
-		if !ok {
-			return errors.New("not lock owner")
+		err = f(ctx, ts, tx)
+		if o.autoCommit && tx != nil {
+			err = finishTx(ctx, tx, err)
 		}
-		return f(ctx, ts, tx)
-	})
+		if !o.idempotent && ClassifyError(err) == ErrorClassAborted {
+			aborted = err
+			return nil
+		}
+		return err
+	}, doOpts...)
+	if aborted != nil {
+		return aborted
+	}
+	return err
+}
+
+// ExecuteGuarded runs a write query guarded by the lease check in a single round trip, see the package-level
+// ExecuteGuarded and LockRequestBuilder.GetGuardedQueryWithParams.
+// If ctx carries a lease of this lock its generation is checked as well.
+func (s *YdbLockStorage) ExecuteGuarded(ctx context.Context, lockName string, ownerName string, query string, params *table.QueryParameters) error {
+	start := time.Now()
+	err := ExecuteGuarded(ctx, s.Db.Table(), lockName, ownerName, leaseGeneration(ctx, lockName, ownerName), query, params, s.ReqBuilder)
+	metricsOrNop(s.Metrics).StorageRequest("execute_guarded", lockName, time.Since(start), err)
+	loggerOrNop(s.Logger).Debug("ydb execute guarded", "lock", lockName, "owner", ownerName, "latency", time.Since(start),
+		"error", err, "error_class", ClassifyError(err))
+	return err
 }
 
 type LocalLock struct {
-	OwnerName string
-	Deadline  time.Time
+	OwnerName  string
+	Deadline   time.Time
+	Generation uint64
+	Metadata   []byte
+}
+
+// localClock is the time source of the local storages. Clock is the source of the current time for deadlines,
+// a fake one makes tests deterministic, nil means the real clock.
+type localClock struct {
+	Clock clockwork.Clock
+}
+
+func (c *localClock) now() time.Time {
+	if c.Clock == nil {
+		return time.Now()
+	}
+	return c.Clock.Now()
 }
 
 type LocalLockStorage struct {
 	Locks map[string]*LocalLock
 	Mu    sync.Mutex
+	localClock
 }
 
 func NewLocalLockStorage() *LocalLockStorage {
 	return &LocalLockStorage{
-		Locks: make(map[string]*LocalLock),
+		Locks:      make(map[string]*LocalLock),
+		localClock: localClock{Clock: clockwork.NewRealClock()},
 	}
 }
 
@@ -72,37 +203,106 @@ func (s *LocalLockStorage) CreateLock(ctx context.Context, lockName string) (boo
 	return true, nil
 }
 
-func (s *LocalLockStorage) TryLock(ctx context.Context, lockName string, ownerName string, ttl time.Duration) (string, time.Time, error) {
+func (s *LocalLockStorage) TryLock(ctx context.Context, lockName string, ownerName string, ttl time.Duration) (string, time.Time, uint64, error) {
 	s.Mu.Lock()
 	defer s.Mu.Unlock()
 	if lock, ok := s.Locks[lockName]; ok {
+		now := s.now()
 		if lock.OwnerName == ownerName {
-			lock.Deadline = time.Now().Add(ttl)
-		} else if lock.Deadline.Before(time.Now()) {
+			lock.Deadline = now.Add(ttl)
+		} else if lock.Deadline.Before(now) {
 			lock.OwnerName = ownerName
-			lock.Deadline = time.Now().Add(ttl)
+			lock.Deadline = now.Add(ttl)
+			lock.Generation++
+			lock.Metadata = nil
 		}
-		return lock.OwnerName, lock.Deadline, nil
+		return lock.OwnerName, lock.Deadline, lock.Generation, nil
 	}
-	return "", time.Time{}, errors.New("lock not found")
+	return "", time.Time{}, 0, ErrLockNotFound
 }
 
-func (s *LocalLockStorage) CheckLockOwner(ctx context.Context, ts table.Session, lockName string, ownerName string) (bool, table.Transaction, error) {
+func (s *LocalLockStorage) Release(ctx context.Context, lockName string, ownerName string) (bool, error) {
 	s.Mu.Lock()
 	defer s.Mu.Unlock()
 	if lock, ok := s.Locks[lockName]; ok {
-		return lock.OwnerName == ownerName, nil, nil
+		if lock.OwnerName != ownerName {
+			return false, nil
+		}
+		now := s.now()
+		released := lock.Deadline.After(now)
+		lock.OwnerName = ""
+		lock.Deadline = now
+		lock.Metadata = nil
+		return released, nil
 	}
-	return false, nil, errors.New("lock not found")
+	return false, ErrLockNotFound
 }
 
-func (s *LocalLockStorage) ExecuteUnderLock(ctx context.Context, lockName string, ownerName string, f func(ctx context.Context, ts table.Session, tx table.Transaction) error) error {
+func (s *LocalLockStorage) GetLock(ctx context.Context, lockName string) (LockInfo, error) {
 	s.Mu.Lock()
 	defer s.Mu.Unlock()
 	if lock, ok := s.Locks[lockName]; ok {
-		if lock.OwnerName == ownerName {
-			return f(ctx, nil, nil)
+		return LockInfo{
+			LockName:   lockName,
+			Owner:      lock.OwnerName,
+			Deadline:   lock.Deadline,
+			Generation: lock.Generation,
+			Metadata:   bytes.Clone(lock.Metadata),
+			Alive:      lock.Deadline.After(s.now()),
+		}, nil
+	}
+	return LockInfo{}, ErrLockNotFound
+}
+
+func (s *LocalLockStorage) SetMetadata(ctx context.Context, lockName string, ownerName string, metadata []byte) (bool, error) {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	if lock, ok := s.Locks[lockName]; ok {
+		if lock.OwnerName != ownerName || !lock.Deadline.After(s.now()) {
+			return false, nil
 		}
+		lock.Metadata = bytes.Clone(metadata)
+		return true, nil
+	}
+	return false, ErrLockNotFound
+}
+
+func (s *LocalLockStorage) CheckLockOwner(ctx context.Context, ts table.Session, lockName string, ownerName string) (bool, table.Transaction, error) {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	if lock, ok := s.Locks[lockName]; ok {
+		return lock.OwnerName == ownerName && lock.Deadline.After(s.now()), nil, nil
+	}
+	return false, nil, ErrLockNotFound
+}
+
+// ExecuteUnderLock checks the lease, including the generation of a lease carried by ctx, and runs f without holding Mu,
+// so renewals are not blocked by f. There is no transaction, the options have no effect.
+func (s *LocalLockStorage) ExecuteUnderLock(ctx context.Context, lockName string, ownerName string, f func(ctx context.Context, ts table.Session, tx table.Transaction) error, opts ...ExecuteOption) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := s.checkLease(lockName, ownerName, leaseGeneration(ctx, lockName, ownerName)); err != nil {
+		return err
+	}
+	return f(ctx, nil, nil)
+}
+
+func (s *LocalLockStorage) checkLease(lockName string, ownerName string, generation uint64) error {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	lock, ok := s.Locks[lockName]
+	if !ok {
+		return ErrLockNotFound
+	}
+	if lock.OwnerName != ownerName {
+		return ErrNotOwner
+	}
+	if !lock.Deadline.After(s.now()) {
+		return ErrLockExpired
+	}
+	if generation != 0 && lock.Generation != generation {
+		return fmt.Errorf("%w: generation %d, lease generation %d", ErrLockExpired, lock.Generation, generation)
 	}
-	return errors.New("lock not found")
+	return nil
 }
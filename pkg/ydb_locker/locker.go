@@ -1,8 +1,12 @@
 package ydb_locker
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"github.com/ydb-platform/ydb-go-sdk/v3/table"
+	"log/slog"
+	"sync"
 	"time"
 )
 
@@ -12,27 +16,230 @@ type Locker struct {
 	OwnerName   string
 	Ttl         time.Duration
 
+	// FuncsToRun is the queue of ExecuteUnderLock calls, it is served separately from the renewal loop
+	// by a single LockerContext worker, so the calls do not overlap. See WithMaxConcurrentExecutions to run more at once.
 	FuncsToRun chan func()
+
+	// OnError receives every error of the locker: failed lock creation attempts, renewal and release errors.
+	// Whether an error is fatal is up to the application, see Err for the terminal one.
+	OnError func(error)
+	// Logger receives structured lock lifecycle events, NewLocker sets a no-op one.
+	Logger *slog.Logger
+	// Metrics is notified about acquisitions, losses, renewals and ExecuteUnderLock calls.
+	Metrics Metrics
+
+	errMu sync.Mutex
+	err   error
+
+	subsMu sync.Mutex
+	subs   map[chan LockEvent]struct{}
+
+	metadataMu sync.Mutex
+	metadata   []byte
+
+	options *lockerOptions
+
+	// runMu guards the state of the current LockerContext run, ExecuteUnderLock is only accepted while it is running.
+	runMu    sync.Mutex
+	running  bool
+	stopRun  context.CancelCauseFunc
+	runDone  chan struct{}
+	inflight sync.WaitGroup
 }
 
-func NewLocker(lockStorage LockStorage, lockName string, ownerName string, ttl time.Duration) *Locker {
+func NewLocker(lockStorage LockStorage, lockName string, ownerName string, ttl time.Duration, opts ...LockerOption) *Locker {
+	options := newLockerOptions(opts...).clamp(ttl)
 	return &Locker{
 		LockStorage: lockStorage,
 		LockName:    lockName,
 		OwnerName:   ownerName,
 		Ttl:         ttl,
-		FuncsToRun:  make(chan func(), 1000),
+		FuncsToRun:  make(chan func(), options.funcsToRunBufferSize),
+		OnError:     options.onError,
+		Logger:      loggerOrNop(options.logger),
+		Metrics:     metricsOrNop(options.metrics),
+		options:     options,
+	}
+}
+
+// opts returns the options the locker was created with, defaults for a Locker built without NewLocker.
+func (l *Locker) opts() *lockerOptions {
+	if l.options == nil {
+		return defaultLockerOptions()
 	}
+	return l.options
 }
 
-func (l *Locker) ExecuteUnderLock(ctx context.Context, f func(context.Context, table.Session, table.Transaction) error) error {
+// ExecuteUnderLock runs f if the lock is held, opts configure its transaction. A panic in f is returned as *PanicError,
+// with WithStepDownOnPanic the locker also gives the lock up.
+// ErrLockerStopped is returned if there is no LockerContext run or it stops before f is started.
+// Only a LockerContext run serves the calls: a lock held with Acquire, TryAcquire or Mutex gets ErrLockerStopped,
+// run f with LockStorage.ExecuteUnderLock(lease.Context(), ...) there instead.
+func (l *Locker) ExecuteUnderLock(ctx context.Context, f func(context.Context, table.Session, table.Transaction) error, opts ...ExecuteOption) error {
+	l.runMu.Lock()
+	if !l.running {
+		l.runMu.Unlock()
+		return ErrLockerStopped
+	}
+	done := l.runDone
+	l.inflight.Add(1)
+	l.runMu.Unlock()
+	defer l.inflight.Done()
+
 	res := make(chan error, 1)
-	l.FuncsToRun <- func() {
-		res <- l.LockStorage.ExecuteUnderLock(ctx, l.LockName, l.OwnerName, f)
+	fn := func() {
+		// The call was given up by its caller, who has already got ctx.Err(), do not run it late.
+		if err := ctx.Err(); err != nil {
+			res <- err
+			return
+		}
+		// The call was given up together with its run, do not let a later run execute it.
+		select {
+		case <-done:
+			res <- ErrLockerStopped
+			return
+		default:
+		}
+		clock := l.opts().clock
+		start := clock.Now()
+		err := l.LockStorage.ExecuteUnderLock(ctx, l.LockName, l.OwnerName, recoverUnderLock(f), opts...)
+		metricsOrNop(l.Metrics).ExecutedUnderLock(l.LockName, clock.Since(start), err)
+		var panicErr *PanicError
+		if errors.As(err, &panicErr) {
+			loggerOrNop(l.Logger).Error("function under lock panicked", "lock", l.LockName, "owner", l.OwnerName,
+				"panic", panicErr.Value, "stack", string(panicErr.Stack))
+			if l.opts().stepDownOnPanic {
+				l.stepDown(panicErr)
+			}
+		}
+		res <- err
+	}
+
+	select {
+	case l.FuncsToRun <- fn:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-done:
+		return ErrLockerStopped
+	}
+	select {
+	case err := <-res:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-done:
+		// Workers are finished by now, f either ran or never will.
+		select {
+		case err := <-res:
+			return err
+		default:
+			return ErrLockerStopped
+		}
+	}
+}
+
+// Close stops accepting ExecuteUnderLock calls, waits for the accepted ones and then stops
+// the LockerContext run, which releases the lock. It returns the terminal error of the run, see Err.
+func (l *Locker) Close() error {
+	l.runMu.Lock()
+	l.running = false
+	stopRun, done := l.stopRun, l.runDone
+	l.runMu.Unlock()
+
+	l.inflight.Wait()
+	if stopRun != nil {
+		stopRun(nil)
+		<-done
+	}
+	return l.Err()
+}
+
+func recoverUnderLock(f func(context.Context, table.Session, table.Transaction) error) func(context.Context, table.Session, table.Transaction) error {
+	return func(ctx context.Context, ts table.Session, tx table.Transaction) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = newPanicError(r)
+			}
+		}()
+		return f(ctx, ts, tx)
+	}
+}
+
+// stepDown stops the current LockerContext run: the lease contexts are cancelled and the lock is released.
+func (l *Locker) stepDown(cause error) {
+	l.runMu.Lock()
+	defer l.runMu.Unlock()
+	if l.stopRun != nil {
+		l.stopRun(cause)
 	}
-	return <-res
 }
 
 func (l *Locker) LockerContext(ctx context.Context) chan context.Context {
-	return LockerContext(ctx, l.LockStorage, l.LockName, l.OwnerName, l.Ttl, l.FuncsToRun)
+	o := l.opts()
+	// The hooks come from the fields, they may be changed after NewLocker.
+	run := *o
+	run.onError, run.logger, run.metrics = l.OnError, l.Logger, l.Metrics
+	run.notify, run.metadata = l.publish, l.getMetadata
+	lockCtxs := make(chan context.Context, o.eventBufferSize)
+	runCtx, stopRun := context.WithCancelCause(ctx)
+	done := make(chan struct{})
+	l.runMu.Lock()
+	l.running = true
+	l.stopRun = stopRun
+	l.runDone = done
+	l.runMu.Unlock()
+
+	go func() {
+		defer close(lockCtxs)
+		defer close(done)
+		defer func() {
+			l.runMu.Lock()
+			if l.runDone == done {
+				l.running = false
+			}
+			l.runMu.Unlock()
+		}()
+		err := lockerContext(runCtx, l.LockStorage, l.LockName, l.OwnerName, l.Ttl, lockCtxs, l.FuncsToRun, &run)
+		var panicErr *PanicError
+		if err == nil && errors.As(context.Cause(runCtx), &panicErr) {
+			err = panicErr
+		}
+		stopRun(nil)
+		l.errMu.Lock()
+		l.err = err
+		l.errMu.Unlock()
+	}()
+
+	return lockCtxs
+}
+
+// SetMetadata sets the metadata published on every acquisition (e.g. the leader address) and,
+// if the lock is held right now, updates it in the storage.
+func (l *Locker) SetMetadata(ctx context.Context, metadata []byte) error {
+	l.metadataMu.Lock()
+	l.metadata = bytes.Clone(metadata)
+	l.metadataMu.Unlock()
+	_, err := l.LockStorage.SetMetadata(ctx, l.LockName, l.OwnerName, metadata)
+	return err
+}
+
+func (l *Locker) getMetadata() []byte {
+	l.metadataMu.Lock()
+	defer l.metadataMu.Unlock()
+	return l.metadata
+}
+
+// Err returns the error that stopped the last LockerContext run, nil if it was stopped by its context.
+// It is set before the channel returned by LockerContext is closed.
+func (l *Locker) Err() error {
+	l.errMu.Lock()
+	defer l.errMu.Unlock()
+	return l.err
+}
+
+// FencingTokenFromContext returns the generation of the lease the context was handed out for.
+// The token grows every time the lock changes owner, so writers can reject stale leaders.
+func FencingTokenFromContext(ctx context.Context) (uint64, bool) {
+	lease, ok := LeaseFromContext(ctx)
+	return lease.Generation, ok
 }
@@ -1,11 +1,17 @@
 package ydb_locker
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"github.com/google/uuid"
+	"github.com/jonboulle/clockwork"
 	"github.com/ydb-platform/ydb-go-sdk/v3/table"
 	"log"
+	"log/slog"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -77,12 +83,14 @@ func TestYdbLockerCtxSingleWorker(t *testing.T) {
 		"lock_name_123",
 		"owner_456",
 		"deadline_789",
+		"generation_012",
+		"metadata_345",
 	}
 	DropTableIfExists(t, ctx, db.Scripting(), customReqBuilder.TableName)
 	if err := CreateLocksTable(ctx, db.Scripting(), &customReqBuilder); err != nil {
 		t.Errorf("create table error: %v", err)
 	}
-	storage := YdbLockStorage{db, &customReqBuilder}
+	storage := YdbLockStorage{Db: db, ReqBuilder: &customReqBuilder}
 	locker := NewLocker(&storage, "lock1", uuid.New().String(), time.Second*10)
 
 	ctx10s, cancel := context.WithTimeout(ctx, time.Second*10)
@@ -124,7 +132,7 @@ func TestYdbLockerCtxMultipleWorkers(t *testing.T) {
 	for i := 0; i < 10; i++ {
 		wg.Add(1)
 		go func() {
-			storage := YdbLockStorage{db, reqBuilder}
+			storage := YdbLockStorage{Db: db, ReqBuilder: reqBuilder}
 			locker := NewLocker(&storage, lockName, uuid.New().String(), time.Second*10)
 			defer wg.Done()
 
@@ -159,12 +167,14 @@ func TestYdbLockerCtxSingleWorkerLongTx(t *testing.T) {
 		"lock_name_123",
 		"owner_456",
 		"deadline_789",
+		"generation_012",
+		"metadata_345",
 	}
 	DropTableIfExists(t, ctx, db.Scripting(), customReqBuilder.TableName)
 	if err := CreateLocksTable(ctx, db.Scripting(), &customReqBuilder); err != nil {
 		t.Errorf("create table error: %v", err)
 	}
-	storage := YdbLockStorage{db, &customReqBuilder}
+	storage := YdbLockStorage{Db: db, ReqBuilder: &customReqBuilder}
 	locker := NewLocker(&storage, "lock1", uuid.New().String(), time.Second*10)
 
 	ctx10s, cancel := context.WithTimeout(ctx, time.Second*10)
@@ -188,3 +198,882 @@ func TestYdbLockerCtxSingleWorkerLongTx(t *testing.T) {
 		t.Errorf("expected 10, got %d", cntr)
 	}
 }
+
+func TestLocalLockerCtxFencingToken(t *testing.T) {
+	ctx := context.Background()
+	storage := NewLocalLockStorage()
+	if _, err := storage.CreateLock(ctx, "lock1"); err != nil {
+		t.Fatal("create lock error", err)
+	}
+
+	_, _, gen1, err := storage.TryLock(ctx, "lock1", "owner1", time.Millisecond*50)
+	if err != nil {
+		t.Fatal("try lock error", err)
+	}
+	_, _, gen2, _ := storage.TryLock(ctx, "lock1", "owner1", time.Millisecond*50)
+	if gen1 != gen2 {
+		t.Errorf("renewal changed generation: %d != %d", gen1, gen2)
+	}
+
+	time.Sleep(time.Millisecond * 100)
+
+	ctx1s, cancel := context.WithTimeout(ctx, time.Second*1)
+	defer cancel()
+	locker := NewLocker(storage, "lock1", "owner2", time.Millisecond*100)
+	lockCtx := <-locker.LockerContext(ctx1s)
+	token, ok := FencingTokenFromContext(lockCtx)
+	if !ok || token <= gen2 {
+		t.Errorf("expected token greater than %d, got %d", gen2, token)
+	}
+}
+
+func TestLocalLockerCtxReleaseOnStop(t *testing.T) {
+	ctx := context.Background()
+	storage := NewLocalLockStorage()
+	locker := NewLocker(storage, "lock1", "owner1", time.Second*10)
+
+	lockerCtx, cancel := context.WithCancel(ctx)
+	lockCtxs := locker.LockerContext(lockerCtx)
+	<-lockCtxs
+	cancel()
+	for range lockCtxs {
+	}
+
+	owner, _, _, err := storage.TryLock(ctx, "lock1", "owner2", time.Second*10)
+	if err != nil {
+		t.Fatal("try lock error", err)
+	}
+	if owner != "owner2" {
+		t.Errorf("expected released lock to be taken by owner2, got %s", owner)
+	}
+	if released, _ := storage.Release(ctx, "lock1", "owner1"); released {
+		t.Error("release reported success for a non-owner")
+	}
+}
+
+func TestLocalLockerContextHookOptions(t *testing.T) {
+	ctx := context.Background()
+	storage := NewLocalLockStorage()
+	events := make(chan LockEvent, 100)
+
+	lockerCtx, cancel := context.WithCancel(ctx)
+	lockCtxs := LockerContext(lockerCtx, storage, "lock1", "owner1", time.Second*10, nil,
+		WithEventNotify(func(event LockEvent) { events <- event }),
+		WithMetadata(func() []byte { return []byte("addr") }))
+	<-lockCtxs
+	if event := <-events; event.Type != EventAcquired {
+		t.Errorf("expected acquired event, got %v", event.Type)
+	}
+	info, err := storage.GetLock(ctx, "lock1")
+	if err != nil {
+		t.Fatal("get lock error", err)
+	}
+	if string(info.Metadata) != "addr" {
+		t.Errorf("expected metadata addr, got %q", info.Metadata)
+	}
+	cancel()
+	for range lockCtxs {
+	}
+}
+
+type flakyCreateLockStorage struct {
+	*LocalLockStorage
+	failures int
+}
+
+func (s *flakyCreateLockStorage) CreateLock(ctx context.Context, lockName string) (bool, error) {
+	if s.failures > 0 {
+		s.failures--
+		return false, errors.New("storage is unavailable")
+	}
+	return s.LocalLockStorage.CreateLock(ctx, lockName)
+}
+
+func TestLocalLockerCtxCreateLockRetries(t *testing.T) {
+	ctx := context.Background()
+	storage := &flakyCreateLockStorage{NewLocalLockStorage(), 2}
+	locker := NewLocker(storage, "lock1", "owner1", time.Second*10)
+	var errs []error
+	locker.OnError = func(err error) {
+		errs = append(errs, err)
+	}
+
+	ctx5s, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+
+	lockCtxs := locker.LockerContext(ctx5s)
+	if _, ok := <-lockCtxs; !ok {
+		t.Fatal("lock was not acquired:", locker.Err())
+	}
+	cancel()
+	for range lockCtxs {
+	}
+
+	if len(errs) != 2 {
+		t.Errorf("expected 2 reported errors, got %v", errs)
+	}
+	if locker.Err() != nil {
+		t.Errorf("expected graceful stop, got %v", locker.Err())
+	}
+}
+
+func TestLocalLockerCtxLogger(t *testing.T) {
+	ctx := context.Background()
+	storage := NewLocalLockStorage()
+	locker := NewLocker(storage, "lock1", "owner1", time.Second*10)
+	var buf bytes.Buffer
+	locker.Logger = slog.New(slog.NewJSONHandler(&buf, nil))
+
+	lockerCtx, cancel := context.WithCancel(ctx)
+	lockCtxs := locker.LockerContext(lockerCtx)
+	<-lockCtxs
+	cancel()
+	for range lockCtxs {
+	}
+
+	out := buf.String()
+	for _, expected := range []string{`"msg":"lock acquired","lock":"lock1","owner":"owner1"`, `"msg":"lock released"`} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected %s in log output:\n%s", expected, out)
+		}
+	}
+}
+
+func TestLocalLockerMetadata(t *testing.T) {
+	ctx := context.Background()
+	storage := NewLocalLockStorage()
+	locker := NewLocker(storage, "lock1", "owner1", time.Millisecond*100)
+	if err := locker.SetMetadata(ctx, []byte(`{"addr":"host1:80"}`)); !errors.Is(err, ErrLockNotFound) {
+		t.Errorf("expected ErrLockNotFound for a lock that does not exist yet, got %v", err)
+	}
+
+	lockerCtx, cancel := context.WithCancel(ctx)
+	lockCtxs := locker.LockerContext(lockerCtx)
+	<-lockCtxs
+
+	info, err := storage.GetLock(ctx, "lock1")
+	if err != nil {
+		t.Fatal("get lock error", err)
+	}
+	if info.Owner != "owner1" || string(info.Metadata) != `{"addr":"host1:80"}` {
+		t.Errorf("unexpected lock info: %+v", info)
+	}
+
+	if err := locker.SetMetadata(ctx, []byte(`{"addr":"host2:80"}`)); err != nil {
+		t.Fatal("set metadata error", err)
+	}
+	if info, _ := storage.GetLock(ctx, "lock1"); string(info.Metadata) != `{"addr":"host2:80"}` {
+		t.Errorf("metadata was not updated: %s", info.Metadata)
+	}
+	if updated, _ := storage.SetMetadata(ctx, "lock1", "owner2", []byte("x")); updated {
+		t.Error("non-owner updated metadata")
+	}
+
+	cancel()
+	for range lockCtxs {
+	}
+	if info, _ := storage.GetLock(ctx, "lock1"); info.Metadata != nil {
+		t.Errorf("metadata was not cleared on release: %s", info.Metadata)
+	}
+}
+
+// blockingSetMetadataStorage blocks SetMetadata until its context is done.
+type blockingSetMetadataStorage struct {
+	*LocalLockStorage
+}
+
+func (s *blockingSetMetadataStorage) SetMetadata(ctx context.Context, lockName string, ownerName string, metadata []byte) (bool, error) {
+	<-ctx.Done()
+	return false, ctx.Err()
+}
+
+func TestLocalLockerCtxSlowSetMetadata(t *testing.T) {
+	ctx := context.Background()
+	storage := &blockingSetMetadataStorage{NewLocalLockStorage()}
+	locker := NewLocker(storage, "lock1", "owner1", time.Millisecond*300)
+	// Nothing is held yet, only the metadata to publish on acquisition is kept.
+	setCtx, setCancel := context.WithTimeout(ctx, time.Millisecond*10)
+	locker.SetMetadata(setCtx, []byte("host1:80"))
+	setCancel()
+	var onErrorCalls atomic.Int32
+	locker.OnError = func(error) {
+		onErrorCalls.Add(1)
+	}
+
+	ctx5s, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	lockCtxs := locker.LockerContext(ctx5s)
+	lockCtx := <-lockCtxs
+
+	// Longer than the ttl: the hanging request must not hold back the renewals.
+	time.Sleep(time.Millisecond * 600)
+	if lockCtx.Err() != nil {
+		t.Error("lease was lost while metadata was being published:", context.Cause(lockCtx))
+	}
+	if onErrorCalls.Load() == 0 {
+		t.Error("expected the timed out metadata request to be reported")
+	}
+	cancel()
+	for range lockCtxs {
+	}
+}
+
+func TestLocalLockerCtxCancelledOnTakeover(t *testing.T) {
+	ctx := context.Background()
+	storage := NewLocalLockStorage()
+	locker := NewLocker(storage, "lock1", "owner1", time.Second*10)
+
+	ctx5s, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	lockCtx := <-locker.LockerContext(ctx5s)
+
+	storage.Mu.Lock()
+	storage.Locks["lock1"].OwnerName = "admin"
+	storage.Mu.Unlock()
+
+	select {
+	case <-lockCtx.Done():
+		if !errors.Is(context.Cause(lockCtx), ErrLockStolen) {
+			t.Errorf("expected ErrLockStolen cause, got %v", context.Cause(lockCtx))
+		}
+	case <-time.After(time.Second * 3):
+		t.Error("lease context was not cancelled after takeover")
+	}
+}
+
+type failingTryLockStorage struct {
+	*LocalLockStorage
+	failing atomic.Bool
+}
+
+func (s *failingTryLockStorage) TryLock(ctx context.Context, lockName string, ownerName string, ttl time.Duration) (string, time.Time, uint64, error) {
+	if s.failing.Load() {
+		return "", time.Time{}, 0, errors.New("storage is unavailable")
+	}
+	return s.LocalLockStorage.TryLock(ctx, lockName, ownerName, ttl)
+}
+
+// blockingTryLockStorage blocks TryLock of a taken lock until its context is done.
+type blockingTryLockStorage struct {
+	*LocalLockStorage
+	entered chan struct{}
+}
+
+func (s *blockingTryLockStorage) TryLock(ctx context.Context, lockName string, ownerName string, ttl time.Duration) (string, time.Time, uint64, error) {
+	close(s.entered)
+	<-ctx.Done()
+	return "", time.Time{}, 0, ctx.Err()
+}
+
+func TestLocalLockerCtxStopDuringTryLock(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	storage := &blockingTryLockStorage{NewLocalLockStorage(), make(chan struct{})}
+	locker := NewLocker(storage, "lock1", "owner1", time.Second*10)
+	var onErrorCalls atomic.Int32
+	locker.OnError = func(error) {
+		onErrorCalls.Add(1)
+	}
+	events := locker.Subscribe(ctx)
+
+	lockerCtx, stop := context.WithCancel(ctx)
+	lockCtxs := locker.LockerContext(lockerCtx)
+	<-storage.entered
+	stop()
+	for range lockCtxs {
+	}
+
+	if n := onErrorCalls.Load(); n != 0 {
+		t.Errorf("expected no errors on a graceful stop, got %d", n)
+	}
+	for len(events) > 0 {
+		if event := <-events; event.Type == EventStorageError {
+			t.Errorf("unexpected storage error event on a graceful stop: %v", event.Err)
+		}
+	}
+}
+
+func TestLocalLockerCtxTerminalError(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	clock := clockwork.NewFakeClock()
+	locker := NewLocker(&flakyCreateLockStorage{NewLocalLockStorage(), defaultCreateLockAttempts}, "lock1", "owner1", time.Second, WithClock(clock))
+	var onErrorCalls atomic.Int32
+	locker.OnError = func(error) {
+		onErrorCalls.Add(1)
+	}
+
+	lockCtxs := locker.LockerContext(ctx)
+	// Skip the backoff of the lock creation retries.
+	go func() {
+		for ctx.Err() == nil {
+			clock.Advance(time.Second * 10)
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	select {
+	case _, ok := <-lockCtxs:
+		if ok {
+			t.Fatal("lock acquired without a lock row")
+		}
+	case <-ctx.Done():
+		t.Fatal("locker did not stop after failing to create the lock")
+	}
+	if err := locker.Err(); err == nil || !strings.Contains(err.Error(), "storage is unavailable") {
+		t.Errorf("expected the create lock error, got %v", err)
+	}
+	if onErrorCalls.Load() != defaultCreateLockAttempts-1 {
+		t.Errorf("expected %d retried errors, got %d", defaultCreateLockAttempts-1, onErrorCalls.Load())
+	}
+	if err := locker.ExecuteUnderLock(ctx, func(context.Context, table.Session, table.Transaction) error { return nil }); !errors.Is(err, ErrLockerStopped) {
+		t.Errorf("expected ErrLockerStopped, got %v", err)
+	}
+}
+
+func TestLocalLockerCtxCreateLockRetriesOption(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	storage := &flakyCreateLockStorage{NewLocalLockStorage(), 2}
+	locker := NewLocker(storage, "lock1", "owner1", time.Second, WithCreateLockRetries(2, time.Millisecond, time.Millisecond))
+
+	for range locker.LockerContext(ctx) {
+		t.Fatal("lock acquired without a lock row")
+	}
+	if err := locker.Err(); err == nil || !strings.Contains(err.Error(), "attempt 2/2") {
+		t.Errorf("expected the create lock error of the second attempt, got %v", err)
+	}
+}
+
+func TestLocalLockerCtxCancelCauses(t *testing.T) {
+	ctx := context.Background()
+	storage := &failingTryLockStorage{LocalLockStorage: NewLocalLockStorage()}
+	locker := NewLocker(storage, "lock1", "owner1", time.Second)
+
+	ctx5s, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	lockCtxs := locker.LockerContext(ctx5s)
+
+	lockCtx := <-lockCtxs
+	storage.failing.Store(true)
+	select {
+	case <-lockCtx.Done():
+		if !errors.Is(context.Cause(lockCtx), ErrStorageUnavailable) {
+			t.Errorf("expected ErrStorageUnavailable cause, got %v", context.Cause(lockCtx))
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("lease context was not cancelled after expiry")
+	}
+
+	storage.failing.Store(false)
+	lockCtx = <-lockCtxs
+	cancel()
+	<-lockCtx.Done()
+	if !errors.Is(context.Cause(lockCtx), ErrLockerStopped) || !errors.Is(context.Cause(lockCtx), context.Canceled) {
+		t.Errorf("expected ErrLockerStopped wrapping context.Canceled, got %v", context.Cause(lockCtx))
+	}
+	for range lockCtxs {
+	}
+}
+
+func TestLocalLockerCtxLeaseDeadline(t *testing.T) {
+	ctx := context.Background()
+	locker := NewLocker(NewLocalLockStorage(), "lock1", "owner1", time.Second)
+
+	ctx5s, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	lockCtxs := locker.LockerContext(ctx5s)
+	lockCtx := <-lockCtxs
+
+	lease, ok := LeaseFromContext(lockCtx)
+	if !ok || lease.LockName != "lock1" || lease.Owner != "owner1" || lease.Generation != 1 {
+		t.Fatalf("unexpected lease %+v, ok=%v", lease, ok)
+	}
+	deadline, ok := lockCtx.Deadline()
+	if !ok || !deadline.Equal(lease.Deadline) || time.Until(deadline) > time.Second {
+		t.Errorf("unexpected lease context deadline %v, lease deadline %v", deadline, lease.Deadline)
+	}
+
+	// Renewals move the deadline of the already yielded context.
+	time.Sleep(time.Millisecond * 500)
+	if renewed, _ := lockCtx.Deadline(); !renewed.After(deadline) {
+		t.Errorf("deadline was not refreshed: %v, first %v", renewed, deadline)
+	}
+	if lockCtx.Err() != nil {
+		t.Error("lease context is cancelled while the lock is renewed")
+	}
+
+	childCtx, childCancel := context.WithCancel(lockCtx)
+	defer childCancel()
+	if token, ok := FencingTokenFromContext(childCtx); !ok || token != 1 {
+		t.Errorf("unexpected fencing token %v, ok=%v", token, ok)
+	}
+	if _, ok := LeaseFromContext(ctx5s); ok {
+		t.Error("lease found in a context that was not yielded by the locker")
+	}
+
+	cancel()
+	for range lockCtxs {
+	}
+	<-childCtx.Done()
+}
+
+type renewCountingMetrics struct {
+	NopMetrics
+	renewals atomic.Int64
+}
+
+func (m *renewCountingMetrics) LockRenewed(string, time.Duration, error) {
+	m.renewals.Add(1)
+}
+
+// waitForTimers waits until n timers of the locker loop wait on the fake clock, failing the test if ctx is done first.
+func waitForTimers(t *testing.T, ctx context.Context, clock clockwork.FakeClock, n int) {
+	blocked := make(chan struct{})
+	go func() {
+		clock.BlockUntil(n)
+		close(blocked)
+	}()
+	select {
+	case <-blocked:
+	case <-ctx.Done():
+		t.Fatal("locker loop is stuck")
+	}
+}
+
+func TestLocalLockerCtxOptions(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	clock := clockwork.NewFakeClock()
+	storage := NewLocalLockStorage()
+	storage.Clock = clock
+	metrics := &renewCountingMetrics{}
+	locker := NewLocker(storage, "lock1", "owner1", time.Second*10,
+		WithClock(clock),
+		WithRenewInterval(func(time.Duration) time.Duration { return time.Millisecond * 100 }),
+		WithRenewJitter(0),
+		WithSafetyMargin(time.Second*2),
+		WithFuncsToRunBufferSize(5),
+	)
+	locker.Metrics = metrics
+	if cap(locker.FuncsToRun) != 5 {
+		t.Errorf("expected FuncsToRun buffer 5, got %d", cap(locker.FuncsToRun))
+	}
+
+	start := clock.Now()
+	lockCtxs := locker.LockerContext(ctx)
+	lockCtx := <-lockCtxs
+	// The renewal timer of the thread and the expiry timer of the lease.
+	waitForTimers(t, ctx, clock, 2)
+
+	lease, _ := LeaseFromContext(lockCtx)
+	if expected := start.Add(time.Second * 8); !lease.Deadline.Equal(expected) {
+		t.Errorf("expected the deadline 10s away less the 2s margin, %v, got %v", expected, lease.Deadline)
+	}
+	// A renewal every 100ms for a second.
+	for i := 0; i < 10; i++ {
+		clock.Advance(time.Millisecond * 100)
+		waitForTimers(t, ctx, clock, 2)
+	}
+	if n := metrics.renewals.Load(); n != 11 {
+		t.Errorf("expected the acquisition and 10 renewals, got %d", n)
+	}
+
+	cancel()
+	for range lockCtxs {
+	}
+}
+
+func TestLocalLockerCtxVirtualTime(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	clock := clockwork.NewFakeClock()
+	storage := &failingTryLockStorage{LocalLockStorage: NewLocalLockStorage()}
+	storage.Clock = clock
+	locker := NewLocker(storage, "lock1", "owner1", time.Second*10, WithClock(clock), WithRenewJitter(0))
+	events := locker.Subscribe(ctx)
+
+	// advance moves the virtual time by a renew interval and waits for the loop to schedule its timers again.
+	advance := func(waiters int) {
+		clock.Advance(time.Second)
+		waitForTimers(t, ctx, clock, waiters)
+	}
+	waitEvent := func(eventType LockEventType) LockEvent {
+		for {
+			select {
+			case event := <-events:
+				if event.Type == eventType {
+					return event
+				}
+			case <-ctx.Done():
+				t.Fatalf("no %v event", eventType)
+			}
+		}
+	}
+
+	// Acquisition: the renewal timer of the thread and the expiry timer of the lease.
+	start := clock.Now()
+	lockCtxs := locker.LockerContext(ctx)
+	lockCtx := <-lockCtxs
+	waitForTimers(t, ctx, clock, 2)
+	if deadline, _ := lockCtx.Deadline(); !deadline.Equal(start.Add(time.Second * 10)) {
+		t.Errorf("unexpected deadline %v after acquisition at %v", deadline, start)
+	}
+
+	// Renewal.
+	advance(2)
+	waitEvent(EventRenewed)
+	if deadline, _ := lockCtx.Deadline(); !deadline.Equal(start.Add(time.Second * 11)) {
+		t.Errorf("unexpected deadline %v after renewal", deadline)
+	}
+
+	// Expiry: renewals fail until the deadline passes.
+	storage.failing.Store(true)
+	for i := 0; i < 9; i++ {
+		advance(2)
+	}
+	if lockCtx.Err() != nil {
+		t.Fatal("lease ended before its deadline:", context.Cause(lockCtx))
+	}
+	advance(1)
+	<-lockCtx.Done()
+	if !errors.Is(context.Cause(lockCtx), ErrStorageUnavailable) {
+		t.Errorf("expected ErrStorageUnavailable cause, got %v", context.Cause(lockCtx))
+	}
+	waitEvent(EventExpired)
+
+	// Takeover: another owner grabs the expired lock, the loop notices it on the next renewal.
+	clock.Advance(time.Millisecond)
+	if owner, _, generation, _ := storage.LocalLockStorage.TryLock(ctx, "lock1", "owner2", time.Second*10); owner != "owner2" || generation != 2 {
+		t.Fatalf("owner2 did not take the expired lock: %s, generation %d", owner, generation)
+	}
+	storage.failing.Store(false)
+	advance(1)
+	if event := waitEvent(EventLostToOwner); event.Owner != "owner2" {
+		t.Errorf("expected the lock lost to owner2, got %s", event.Owner)
+	}
+
+	// Re-acquisition once the lease of owner2 is over.
+	for i := 0; i < 10; i++ {
+		advance(1)
+	}
+	lockCtx = <-lockCtxs
+	if token, _ := FencingTokenFromContext(lockCtx); token != 3 {
+		t.Errorf("expected generation 3 after re-acquisition, got %d", token)
+	}
+
+	cancel()
+	for range lockCtxs {
+	}
+}
+
+func TestLocalLockerCtxReacquiredAfterTakeover(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	clock := clockwork.NewFakeClock()
+	storage := &failingTryLockStorage{LocalLockStorage: NewLocalLockStorage()}
+	storage.Clock = clock
+	locker := NewLocker(storage, "lock1", "owner1", time.Second*10, WithClock(clock), WithRenewJitter(0))
+	events := locker.Subscribe(ctx)
+
+	advance := func(waiters int) {
+		clock.Advance(time.Second)
+		waitForTimers(t, ctx, clock, waiters)
+	}
+
+	lockCtxs := locker.LockerContext(ctx)
+	lockCtx := <-lockCtxs
+	waitForTimers(t, ctx, clock, 2)
+
+	// The lease expires while the storage is unavailable, owner2 takes the lock and gives it up.
+	storage.failing.Store(true)
+	for i := 0; i < 9; i++ {
+		advance(2)
+	}
+	advance(1)
+	<-lockCtx.Done()
+	clock.Advance(time.Millisecond)
+	if owner, _, _, _ := storage.LocalLockStorage.TryLock(ctx, "lock1", "owner2", time.Second*10); owner != "owner2" {
+		t.Fatalf("owner2 did not take the expired lock: %s", owner)
+	}
+	storage.LocalLockStorage.Release(ctx, "lock1", "owner2")
+
+	// The next successful renewal is a new lease of owner1.
+	storage.failing.Store(false)
+	advance(2)
+	lockCtx = <-lockCtxs
+	if token, _ := FencingTokenFromContext(lockCtx); token != 3 {
+		t.Errorf("expected generation 3 after re-acquisition, got %d", token)
+	}
+	for {
+		event := <-events
+		if event.Type == EventRenewed {
+			t.Fatalf("new lease reported as renewal: generation %d", event.Generation)
+		}
+		if event.Type == EventAcquired && event.Generation == 3 {
+			break
+		}
+	}
+
+	cancel()
+	for range lockCtxs {
+	}
+}
+
+func TestLocalLockStorageErrors(t *testing.T) {
+	ctx := context.Background()
+	clock := clockwork.NewFakeClock()
+	storage := NewLocalLockStorage()
+	storage.Clock = clock
+	noop := func(context.Context, table.Session, table.Transaction) error { return nil }
+
+	if _, _, _, err := storage.TryLock(ctx, "lock1", "owner1", time.Second); !errors.Is(err, ErrLockNotFound) {
+		t.Errorf("expected ErrLockNotFound from TryLock, got %v", err)
+	}
+	if _, err := storage.GetLock(ctx, "lock1"); !errors.Is(err, ErrLockNotFound) {
+		t.Errorf("expected ErrLockNotFound from GetLock, got %v", err)
+	}
+	if err := storage.ExecuteUnderLock(ctx, "lock1", "owner1", noop); !errors.Is(err, ErrLockNotFound) {
+		t.Errorf("expected ErrLockNotFound from ExecuteUnderLock, got %v", err)
+	}
+
+	storage.CreateLock(ctx, "lock1")
+	storage.TryLock(ctx, "lock1", "owner1", time.Second)
+	if err := storage.ExecuteUnderLock(ctx, "lock1", "owner2", noop); !errors.Is(err, ErrNotOwner) {
+		t.Errorf("expected ErrNotOwner, got %v", err)
+	}
+	if err := storage.ExecuteUnderLock(ctx, "lock1", "owner1", noop); err != nil {
+		t.Errorf("unexpected error under a live lease: %v", err)
+	}
+	clock.Advance(time.Second)
+	if err := storage.ExecuteUnderLock(ctx, "lock1", "owner1", noop); !errors.Is(err, ErrLockExpired) {
+		t.Errorf("expected ErrLockExpired, got %v", err)
+	}
+
+	// owner1 takes the lock again after owner2, a context of its first lease is stale
+	storage.TryLock(ctx, "lock1", "owner2", time.Second)
+	clock.Advance(time.Second)
+	_, _, generation, _ := storage.TryLock(ctx, "lock1", "owner1", time.Second)
+	leaseCtx := func(generation uint64) context.Context {
+		return &leaseContext{Context: ctx, lockName: "lock1", owner: "owner1", generation: generation, deadline: &atomic.Int64{}}
+	}
+	if err := storage.ExecuteUnderLock(leaseCtx(generation-2), "lock1", "owner1", noop); !errors.Is(err, ErrLockExpired) {
+		t.Errorf("expected ErrLockExpired for a stale generation, got %v", err)
+	}
+	if err := storage.ExecuteUnderLock(leaseCtx(generation), "lock1", "owner1", noop); err != nil {
+		t.Errorf("unexpected error for the current generation: %v", err)
+	}
+}
+
+func TestLocalLockerExecuteUnderLockConcurrently(t *testing.T) {
+	ctx := context.Background()
+	// By default the calls do not overlap.
+	for expected, opts := range map[int64][]LockerOption{1: nil, 2: {WithMaxConcurrentExecutions(2)}} {
+		locker := NewLocker(NewLocalLockStorage(), "lock1", "owner1", time.Millisecond*300, opts...)
+
+		ctx5s, cancel := context.WithTimeout(ctx, time.Second*5)
+		lockCtxs := locker.LockerContext(ctx5s)
+		lockCtx := <-lockCtxs
+
+		var running, maxRunning atomic.Int64
+		var wg sync.WaitGroup
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := locker.ExecuteUnderLock(lockCtx, func(context.Context, table.Session, table.Transaction) error {
+					n := running.Add(1)
+					for {
+						m := maxRunning.Load()
+						if n <= m || maxRunning.CompareAndSwap(m, n) {
+							break
+						}
+					}
+					// Longer than the ttl: the lease must survive it.
+					time.Sleep(time.Millisecond * 500)
+					running.Add(-1)
+					return nil
+				})
+				if err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if maxRunning.Load() != expected {
+			t.Errorf("expected %d functions running at once, got %d", expected, maxRunning.Load())
+		}
+		if lockCtx.Err() != nil {
+			t.Error("lease was lost while functions ran under it:", context.Cause(lockCtx))
+		}
+		cancel()
+		for range lockCtxs {
+		}
+	}
+}
+
+func TestLocalLockerExecuteUnderLockPanic(t *testing.T) {
+	ctx := context.Background()
+	panicking := func(context.Context, table.Session, table.Transaction) error {
+		panic("boom")
+	}
+
+	for _, stepDown := range []bool{false, true} {
+		var opts []LockerOption
+		if stepDown {
+			opts = append(opts, WithStepDownOnPanic())
+		}
+		storage := NewLocalLockStorage()
+		locker := NewLocker(storage, "lock1", "owner1", time.Second*10, opts...)
+
+		ctx5s, cancel := context.WithTimeout(ctx, time.Second*5)
+		lockCtxs := locker.LockerContext(ctx5s)
+		lockCtx := <-lockCtxs
+
+		err := locker.ExecuteUnderLock(lockCtx, panicking)
+		var panicErr *PanicError
+		if !errors.As(err, &panicErr) || panicErr.Value != "boom" || !bytes.Contains(panicErr.Stack, []byte("TestLocalLockerExecuteUnderLockPanic")) {
+			t.Fatalf("expected a PanicError with the stack, got %v", err)
+		}
+
+		if !stepDown {
+			if err := locker.ExecuteUnderLock(lockCtx, func(context.Context, table.Session, table.Transaction) error { return nil }); err != nil {
+				t.Errorf("locker is broken after a panic: %v", err)
+			}
+			if lockCtx.Err() != nil {
+				t.Error("lease ended after a panic without step down:", context.Cause(lockCtx))
+			}
+			cancel()
+			for range lockCtxs {
+			}
+			continue
+		}
+
+		for range lockCtxs {
+		}
+		if !errors.As(locker.Err(), &panicErr) {
+			t.Errorf("expected PanicError from Err, got %v", locker.Err())
+		}
+		if cause := context.Cause(lockCtx); !errors.Is(cause, ErrLockerStopped) || !errors.As(cause, &panicErr) {
+			t.Errorf("expected ErrLockerStopped caused by the panic, got %v", cause)
+		}
+		if info, _ := storage.GetLock(ctx, "lock1"); info.Owner != "" {
+			t.Errorf("lock was not released on step down, owner %q", info.Owner)
+		}
+		cancel()
+	}
+}
+
+func TestLocalLockerClose(t *testing.T) {
+	ctx := context.Background()
+	storage := NewLocalLockStorage()
+	locker := NewLocker(storage, "lock1", "owner1", time.Second*10, WithMaxConcurrentExecutions(1))
+	noop := func(context.Context, table.Session, table.Transaction) error { return nil }
+
+	if err := locker.ExecuteUnderLock(ctx, noop); !errors.Is(err, ErrLockerStopped) {
+		t.Errorf("expected ErrLockerStopped before the locker runs, got %v", err)
+	}
+
+	lockCtxs := locker.LockerContext(ctx)
+	lockCtx := <-lockCtxs
+
+	started := make(chan struct{})
+	inFlight := make(chan error, 1)
+	go func() {
+		inFlight <- locker.ExecuteUnderLock(lockCtx, func(context.Context, table.Session, table.Transaction) error {
+			close(started)
+			time.Sleep(time.Millisecond * 300)
+			return nil
+		})
+	}()
+	<-started
+
+	// The only worker is busy: a call with a short ctx gives up instead of blocking.
+	ctx50ms, cancel := context.WithTimeout(ctx, time.Millisecond*50)
+	defer cancel()
+	var abandonedRan atomic.Bool
+	abandoned := func(context.Context, table.Session, table.Transaction) error {
+		abandonedRan.Store(true)
+		return nil
+	}
+	if err := locker.ExecuteUnderLock(ctx50ms, abandoned); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	if err := locker.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-inFlight:
+		if err != nil {
+			t.Errorf("in-flight call failed on Close: %v", err)
+		}
+	default:
+		t.Error("Close returned before the in-flight call finished")
+	}
+	if _, ok := <-lockCtxs; ok {
+		t.Error("LockerContext channel is open after Close")
+	}
+	if abandonedRan.Load() {
+		t.Error("a call given up by its caller ran later")
+	}
+	if info, _ := storage.GetLock(ctx, "lock1"); info.Owner != "" {
+		t.Errorf("lock was not released by Close, owner %q", info.Owner)
+	}
+	if err := locker.ExecuteUnderLock(ctx, noop); !errors.Is(err, ErrLockerStopped) {
+		t.Errorf("expected ErrLockerStopped after Close, got %v", err)
+	}
+}
+
+func TestLocalLockerStopWaitsForFuncUnderLock(t *testing.T) {
+	ctx := context.Background()
+	// With the short ttl f runs for several leases: they must be renewed until it returns.
+	for _, ttl := range []time.Duration{time.Second * 10, time.Millisecond * 200} {
+		storage := NewLocalLockStorage()
+		locker := NewLocker(storage, "lock1", "owner1", ttl)
+
+		lockerCtx, cancel := context.WithCancel(ctx)
+		lockCtxs := locker.LockerContext(lockerCtx)
+		<-lockCtxs
+
+		started := make(chan struct{})
+		finish := make(chan struct{})
+		var finished atomic.Bool
+		go func() {
+			_ = locker.ExecuteUnderLock(ctx, func(context.Context, table.Session, table.Transaction) error {
+				close(started)
+				<-finish
+				finished.Store(true)
+				return nil
+			})
+		}()
+		<-started
+		cancel()
+
+		// The stop must not release the lock while f is still running.
+		for i := 0; i < 50; i++ {
+			time.Sleep(time.Millisecond * 20)
+			owner, _, _, err := storage.TryLock(ctx, "lock1", "owner2", ttl)
+			if err != nil {
+				t.Fatal("try lock error", err)
+			}
+			if owner != "owner1" {
+				t.Fatalf("ttl %v: lock was taken by %q while a function ran under it", ttl, owner)
+			}
+		}
+
+		close(finish)
+		for range lockCtxs {
+		}
+		if !finished.Load() {
+			t.Errorf("ttl %v: locker stopped before the function under the lock returned", ttl)
+		}
+		owner, _, _, err := storage.TryLock(ctx, "lock1", "owner2", ttl)
+		if err != nil {
+			t.Fatal("try lock error", err)
+		}
+		if owner != "owner2" {
+			t.Errorf("ttl %v: expected the lock to be released after the function returned, got owner %q", ttl, owner)
+		}
+	}
+}
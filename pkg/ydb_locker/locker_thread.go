@@ -2,115 +2,487 @@ package ydb_locker
 
 import (
 	"context"
-	"log"
-	"math/rand"
+	"fmt"
+	"github.com/jonboulle/clockwork"
+	"log/slog"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
-func LockerThread(ctx context.Context, deadlineNano *atomic.Int64, lockStorage LockStorage, lockName string, ownerName string, ttl time.Duration, events chan struct{}, funcsToRun <-chan func()) {
-	created, err := lockStorage.CreateLock(ctx, lockName)
-	if err != nil {
-		log.Fatal("create lock error", err)
+// createLockWithRetries retries CreateLock with exponential backoff, reporting every failed attempt to onError.
+func createLockWithRetries(ctx context.Context, lockStorage LockStorage, lockName string, onError func(error), logger *slog.Logger, o *lockerOptions) (bool, error) {
+	retries := o.createLockRetries
+	delay := retries.initial
+	for attempt := 1; ; attempt++ {
+		created, err := lockStorage.CreateLock(ctx, lockName)
+		if err == nil {
+			return created, nil
+		}
+		logger.Warn("create lock failed", "attempt", attempt, "error", err)
+		err = fmt.Errorf("create lock %s (attempt %d/%d): %w", lockName, attempt, retries.attempts, err)
+		if attempt == retries.attempts {
+			return false, err
+		}
+		if onError != nil {
+			onError(err)
+		}
+
+		select {
+		case <-o.clock.After(delay):
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+		delay = retries.next(delay)
+	}
+}
+
+// attemptLock makes a single TryLock bounded by timeout and reports it to metrics,
+// the type of the returned event is left for the caller.
+func attemptLock(ctx context.Context, lockStorage LockStorage, lockName string, ownerName string, ttl time.Duration, metrics Metrics, clock clockwork.Clock, timeout time.Duration) (LockEvent, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := clock.Now()
+	owner, deadline, generation, err := lockStorage.TryLock(ctx, lockName, ownerName, ttl)
+	latency := clock.Since(start)
+	metrics.LockRenewed(lockName, latency, err)
+	return LockEvent{LockName: lockName, Owner: owner, Deadline: deadline, Generation: generation, Timestamp: clock.Now()}, latency, err
+}
+
+// setLockMetadata publishes the holder metadata right after the lock is acquired, failures are only reported.
+// The request is bounded by timeout, a hanging storage must not hold back the renewal of the lease just acquired.
+func setLockMetadata(ctx context.Context, lockStorage LockStorage, lockName string, ownerName string, metadata func() []byte, onError func(error), logger *slog.Logger, timeout time.Duration) {
+	if metadata == nil {
+		return
+	}
+	md := metadata()
+	if md == nil {
 		return
 	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if _, err := lockStorage.SetMetadata(ctx, lockName, ownerName, md); err != nil {
+		logger.Warn("set lock metadata failed", "error", err)
+		if onError != nil {
+			onError(fmt.Errorf("set lock %s metadata: %w", lockName, err))
+		}
+	}
+}
+
+// LockerThread acquires and renews the lock until ctx is done, then releases it.
+// Renewal errors are passed to the WithOnError callback (if set), the returned error is terminal:
+// the lock could not be created even after retries. Graceful stop returns nil.
+func LockerThread(ctx context.Context, deadlineNano *atomic.Int64, lockStorage LockStorage, lockName string, ownerName string, ttl time.Duration, events chan<- LockEvent, opts ...LockerOption) error {
+	return lockerThread(ctx, deadlineNano, lockStorage, lockName, ownerName, ttl, events, nil, newLockerOptions(opts...).clamp(ttl))
+}
+
+// lockerThread is LockerThread that, if workersDone is not nil, keeps renewing the lock it holds after ctx is done
+// and releases it only once workersDone is closed.
+func lockerThread(ctx context.Context, deadlineNano *atomic.Int64, lockStorage LockStorage, lockName string, ownerName string, ttl time.Duration, events chan<- LockEvent, workersDone <-chan struct{}, o *lockerOptions) error {
+	clock := o.clock
+	onError, metadata := o.onError, o.metadata
+	logger := loggerOrNop(o.logger).With("lock", lockName, "owner", ownerName)
+	metrics := metricsOrNop(o.metrics)
+
+	created, err := createLockWithRetries(ctx, lockStorage, lockName, onError, logger, o)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
 	if created {
-		log.Printf("lock %s created", lockName)
+		logger.Info("lock created")
 	}
 
 	isLockAcquired := false
-	nextLockUpdateChan := time.After(0)
+	// generation is the fencing token of the lease held, a successful TryLock with another one is a new lease.
+	var generation uint64
+	failedAttempts := 0
+	nextLockUpdateChan := clock.After(0)
+	// renewCtx is ctx until the stop, then the renewals go on without it while the workers are finishing.
+	renewCtx := ctx
+	stopChan := ctx.Done()
+	var drainChan <-chan struct{}
+
+	release := func() {
+		releaseCtx, cancel := context.WithTimeout(context.Background(), o.releaseTimeout)
+		defer cancel()
+		start := clock.Now()
+		released, err := lockStorage.Release(releaseCtx, lockName, ownerName)
+		if err != nil {
+			logger.Warn("release lock failed", "latency", clock.Since(start), "error", err)
+			if onError != nil {
+				onError(fmt.Errorf("release lock %s: %w", lockName, err))
+			}
+		} else if released {
+			logger.Info("lock released", "latency", clock.Since(start))
+			events <- LockEvent{Type: EventReleased, LockName: lockName, Owner: ownerName, Timestamp: clock.Now()}
+		}
+	}
 
 	for {
 		select {
 		case <-nextLockUpdateChan:
-			curOwner, curTimeout, err := lockStorage.TryLock(ctx, lockName, ownerName, ttl)
-			if err == nil && curOwner == ownerName {
-				deadlineNano.Store(curTimeout.UnixNano())
-				if !isLockAcquired {
-					events <- struct{}{}
+			timeout := o.renewTimeout(ttl, time.Unix(0, deadlineNano.Load()), isLockAcquired)
+			event, latency, err := attemptLock(renewCtx, lockStorage, lockName, ownerName, ttl, metrics, clock, timeout)
+			if err == nil && event.Owner == ownerName {
+				// Somebody else may have held the lock while renewals were failing: the generation tells it,
+				// and a lease that has already ended locally is over for its holders anyway.
+				expired := !o.leaseEnd(time.Unix(0, deadlineNano.Load())).After(clock.Now())
+				deadlineNano.Store(event.Deadline.UnixNano())
+				if !isLockAcquired || event.Generation != generation || expired {
+					logger.Info("lock acquired", "deadline", event.Deadline, "generation", event.Generation, "latency", latency)
+					event.Type = EventAcquired
 					isLockAcquired = true
+					generation = event.Generation
+					setLockMetadata(renewCtx, lockStorage, lockName, ownerName, metadata, onError, logger, o.renewInterval(ttl))
+				} else {
+					logger.Debug("lock renewed", "deadline", event.Deadline, "latency", latency)
+					event.Type = EventRenewed
+				}
+				events <- event
+			} else if err == nil {
+				if isLockAcquired {
+					logger.Info("lock lost", "current_owner", event.Owner, "deadline", event.Deadline, "latency", latency)
+					event.Type = EventLostToOwner
+					events <- event
 				}
-			} else {
 				isLockAcquired = false
 			}
+			if err != nil && renewCtx.Err() != nil {
+				// The request was cancelled by the stop itself, the stop branch takes over.
+				nextLockUpdateChan = nil
+				continue
+			}
 			if err != nil {
-				log.Println(err)
+				// A failed request says nothing about the owner, isLockAcquired is left as is:
+				// the lease stays ours until its deadline.
+				failedAttempts++
+				logger.Warn("try lock failed", "attempt", failedAttempts, "latency", latency, "error", err, "error_class", ClassifyError(err))
+				events <- LockEvent{Type: EventStorageError, LockName: lockName, Err: err, Timestamp: clock.Now()}
+				if onError != nil {
+					onError(fmt.Errorf("try lock %s: %w", lockName, err))
+				}
+			} else {
+				failedAttempts = 0
+			}
+			if isLockAcquired {
+				nextLockUpdateChan = clock.After(o.renewDelay(ttl))
+			} else if drainChan != nil {
+				// Stopping: a lock that is not held any more is not asked for again.
+				nextLockUpdateChan = nil
+			} else {
+				nextLockUpdateChan = clock.After(o.pollDelay(ttl))
 			}
-			ch := time.After(ttl/10 + time.Duration(rand.Int63n(int64(ttl/10))))
-			nextLockUpdateChan = ch
 
-		case fn := <-funcsToRun:
-			fn()
+		case <-stopChan:
+			if workersDone == nil {
+				release()
+				return nil
+			}
+			// A function still running under the lock must not overlap with the next owner:
+			// the lease is renewed until the workers are done.
+			stopChan, drainChan = nil, workersDone
+			renewCtx = context.WithoutCancel(ctx)
+			if !isLockAcquired {
+				nextLockUpdateChan = nil
+			} else if nextLockUpdateChan == nil {
+				// The renewal in flight was cancelled by the stop, the next one is made right away.
+				nextLockUpdateChan = clock.After(0)
+			}
 
+		case <-drainChan:
+			release()
+			return nil
+		}
+	}
+}
+
+func runFuncs(ctx context.Context, funcsToRun <-chan func(), onError func(error)) {
+	for {
+		select {
+		case fn := <-funcsToRun:
+			// Both cases may be ready, a function taken after the stop is dropped: the lock is about to be released.
+			if ctx.Err() != nil {
+				return
+			}
+			if err := runRecovered(fn); err != nil && onError != nil {
+				onError(err)
+			}
 		case <-ctx.Done():
-			func() {
-				ctx3s, cancel := context.WithTimeout(context.Background(), time.Second*3)
-				defer cancel()
-				_, _, err := lockStorage.TryLock(ctx3s, lockName, ownerName, 0)
-				if err != nil {
-					log.Println(err)
-				} else {
-					log.Println("lock released")
-				}
-			}()
 			return
 		}
 	}
 }
 
-func lockerContext(ctx context.Context, lockStorage LockStorage, lockName string, ownerName string, ttl time.Duration, lockCtxs chan context.Context, funcsToRun <-chan func()) {
+// runRecovered keeps a worker alive if a function pushed to FuncsToRun directly panics.
+func runRecovered(fn func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = newPanicError(r)
+		}
+	}()
+	fn()
+	return nil
+}
+
+func lockerStoppedCause(ctx context.Context) error {
+	if cause := context.Cause(ctx); cause != nil {
+		return fmt.Errorf("%w: %w", ErrLockerStopped, cause)
+	}
+	return ErrLockerStopped
+}
+
+func lockerContext(ctx context.Context, lockStorage LockStorage, lockName string, ownerName string, ttl time.Duration, lockCtxs chan context.Context, funcsToRun <-chan func(), o *lockerOptions) error {
+	clock := o.clock
+	onError, notify := o.onError, o.notify
 	var masterDeadline atomic.Int64
 	masterDeadline.Store(0)
 	var wg sync.WaitGroup
 	defer wg.Wait()
-	lockAcquiringEvents := make(chan struct{}, 100)
+	lockEvents := make(chan LockEvent, o.eventBufferSize)
+	threadErr := make(chan error, 1)
+	if notify == nil {
+		notify = func(LockEvent) {}
+	}
+	metrics := metricsOrNop(o.metrics)
 
+	// User functions run on their own workers, a long one must not delay renewals of the lease it runs under.
+	// The workers are stopped on return too, the thread may fail for good while ctx is still alive.
+	// On stop the thread keeps renewing the lease until they are done and only then releases it,
+	// so f never runs after somebody else took the lock, unless the renewals fail.
+	workersCtx, stopWorkers := context.WithCancel(ctx)
+	defer stopWorkers()
+	var workersWg sync.WaitGroup
+	workersDone := make(chan struct{})
+	for i := 0; i < o.maxConcurrentExecutions; i++ {
+		workersWg.Add(1)
+		go func() {
+			defer workersWg.Done()
+			runFuncs(workersCtx, funcsToRun, onError)
+		}()
+	}
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		LockerThread(ctx, &masterDeadline, lockStorage, lockName, ownerName, ttl, lockAcquiringEvents, funcsToRun)
+		workersWg.Wait()
+		close(workersDone)
 	}()
 
-	nextProbExpireChan := make(<-chan time.Time)
-	var cancel context.CancelFunc
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(lockEvents)
+		threadErr <- lockerThread(ctx, &masterDeadline, lockStorage, lockName, ownerName, ttl, lockEvents, workersDone, o)
+	}()
+	// The release event is sent after ctx is done, forward whatever the thread reports until it exits.
 	defer func() {
-		if cancel != nil {
-			cancel()
+		for event := range lockEvents {
+			notify(event)
 		}
 	}()
 
+	// expireTimer fires at the local end of the current lease, nextProbExpireChan is nil while there is none.
+	var expireTimer clockwork.Timer
+	var nextProbExpireChan <-chan time.Time
+	armExpiry := func(end time.Time) {
+		if expireTimer != nil {
+			expireTimer.Stop()
+		}
+		expireTimer = clock.NewTimer(end.Sub(clock.Now()))
+		nextProbExpireChan = expireTimer.Chan()
+	}
+	disarmExpiry := func() {
+		if expireTimer != nil {
+			expireTimer.Stop()
+		}
+		nextProbExpireChan = nil
+	}
+	defer disarmExpiry()
+	var cancel context.CancelCauseFunc
+	// leased is false once the current lease context was ended by the loop,
+	// the context itself may already be cancelled by the parent.
+	leased := false
+	// generation is the fencing token of the current lease context.
+	var generation uint64
+	lastRenewFailed := false
+	// endLease cancels the current lease context, if it is still held, with the given cause.
+	endLease := func(cause error) {
+		if !leased {
+			return
+		}
+		leased = false
+		cancel(cause)
+		metrics.LockLost(lockName)
+		metrics.SetLeader(lockName, false)
+	}
+	defer func() {
+		endLease(lockerStoppedCause(ctx))
+	}()
+
 	for {
 		select {
 		case <-nextProbExpireChan:
 			deadline := time.Unix(0, masterDeadline.Load())
-			if deadline.Compare(time.Now()) <= 0 {
-				cancel()
+			if end := o.leaseEnd(deadline); end.Compare(clock.Now()) <= 0 {
+				disarmExpiry()
+				if lastRenewFailed {
+					endLease(ErrStorageUnavailable)
+				} else {
+					endLease(ErrLeaseExpired)
+				}
+				notify(LockEvent{Type: EventExpired, LockName: lockName, Owner: ownerName, Deadline: deadline, Timestamp: clock.Now()})
 			} else {
-				nextProbExpireChan = time.After(deadline.Sub(time.Now()))
+				armExpiry(end)
 			}
 
-		case <-lockAcquiringEvents:
-			deadline := time.Unix(0, masterDeadline.Load())
-			nextProbExpireChan = time.After(deadline.Sub(time.Now()))
-			var lockCtx context.Context
-			lockCtx, cancel = context.WithCancel(ctx)
-			lockCtxs <- lockCtx
+		case event, ok := <-lockEvents:
+			if !ok {
+				return <-threadErr
+			}
+			switch event.Type {
+			case EventAcquired, EventRenewed:
+				lastRenewFailed = false
+				// The lock was held by somebody else in between, the holders of the old lease must stop.
+				if leased && event.Generation != generation {
+					disarmExpiry()
+					endLease(fmt.Errorf("%w: generation %d replaced by %d", ErrLockStolen, generation, event.Generation))
+				}
+				// A lease that has already ended is replaced by a fresh context.
+				if !leased {
+					armExpiry(o.leaseEnd(time.Unix(0, masterDeadline.Load())))
+					// The parent is not linked directly so that its cancellation is reported as ErrLockerStopped.
+					cancelCtx, leaseCancel := context.WithCancelCause(context.WithoutCancel(ctx))
+					leaseCtx := &leaseContext{Context: cancelCtx, lockName: lockName, owner: ownerName, generation: event.Generation, deadline: &masterDeadline, margin: o.safetyMargin}
+					stop := context.AfterFunc(ctx, func() {
+						leaseCancel(lockerStoppedCause(ctx))
+					})
+					leased = true
+					generation = event.Generation
+					cancel = func(cause error) {
+						stop()
+						leaseCancel(cause)
+					}
+					metrics.LockAcquired(lockName)
+					metrics.SetLeader(lockName, true)
+					lockCtxs <- leaseCtx
+				}
+
+			case EventLostToOwner:
+				// Do not wait for the old deadline, somebody else is already working under the lock.
+				disarmExpiry()
+				endLease(fmt.Errorf("%w: %s", ErrLockStolen, event.Owner))
+
+			case EventStorageError:
+				lastRenewFailed = true
+			}
+			notify(event)
 
 		case <-ctx.Done():
-			return
+			return nil
 		}
 	}
 }
 
-func LockerContext(ctx context.Context, lockStorage LockStorage, lockName string, ownerName string, ttl time.Duration, funcsToRun <-chan func()) chan context.Context {
-	lockCtxs := make(chan context.Context, 100)
+// LockerContext yields a context every time the lock is acquired. The channel is closed once ctx is done
+// or the locker fails for good, in the latter case the terminal error is passed to the WithOnError callback as well.
+func LockerContext(ctx context.Context, lockStorage LockStorage, lockName string, ownerName string, ttl time.Duration, funcsToRun <-chan func(), opts ...LockerOption) chan context.Context {
+	o := newLockerOptions(opts...).clamp(ttl)
+	lockCtxs := make(chan context.Context, o.eventBufferSize)
 
 	go func() {
 		defer close(lockCtxs)
-		lockerContext(ctx, lockStorage, lockName, ownerName, ttl, lockCtxs, funcsToRun)
+		err := lockerContext(ctx, lockStorage, lockName, ownerName, ttl, lockCtxs, funcsToRun, o)
+		if err != nil && o.onError != nil {
+			o.onError(err)
+		}
 	}()
 
 	return lockCtxs
 }
+
+// holderContext runs the acquire/renew/release cycle of LockerThread for primitives
+// that only need to know whether the holder is in (semaphore slots, read-write holders).
+// The hooks come from o: errors go to onError, lifecycle records to logger, acquisitions and renewals to metrics.
+func holderContext(ctx context.Context, name string, ownerName string, tryAcquire func(ctx context.Context) (bool, time.Time, error), release func(ctx context.Context) error, ttl time.Duration, lockCtxs chan context.Context, o *lockerOptions) {
+	clock := o.clock
+	onError := o.onError
+	logger := loggerOrNop(o.logger).With("lock", name, "owner", ownerName)
+	metrics := metricsOrNop(o.metrics)
+	nextUpdateChan := clock.After(0)
+	var expireChan <-chan time.Time
+	// lastDeadline is the deadline of the current holder, it bounds the renewal requests while held.
+	var lastDeadline time.Time
+	var cancel context.CancelFunc
+	// lose cancels the current holder context, if there is one.
+	lose := func(reason string) {
+		if cancel == nil {
+			return
+		}
+		logger.Info("holder lost", "reason", reason)
+		cancel()
+		cancel = nil
+		metrics.LockLost(name)
+		metrics.SetLeader(name, false)
+	}
+	defer lose("stopped")
+
+	for {
+		select {
+		case <-nextUpdateChan:
+			// A hanging request must not keep the holder past its deadline, the expiry is only checked in between.
+			attemptCtx, attemptCancel := context.WithTimeout(ctx, o.renewTimeout(ttl, lastDeadline, cancel != nil))
+			start := clock.Now()
+			acquired, deadline, err := tryAcquire(attemptCtx)
+			attemptCancel()
+			latency := clock.Since(start)
+			metrics.LockRenewed(name, latency, err)
+			if err != nil && ctx.Err() != nil {
+				// The request was cancelled by the stop itself, the ctx.Done branch releases the holder.
+				continue
+			}
+			if err != nil {
+				logger.Warn("try acquire failed", "latency", latency, "error", err, "error_class", ClassifyError(err))
+				if onError != nil {
+					onError(err)
+				}
+			} else if acquired {
+				lastDeadline = deadline
+				expireChan = clock.After(o.leaseEnd(deadline).Sub(clock.Now()))
+				if cancel == nil {
+					logger.Info("holder acquired", "deadline", deadline, "latency", latency)
+					lockCtx, lockCancel := context.WithCancel(ctx)
+					cancel = lockCancel
+					metrics.LockAcquired(name)
+					metrics.SetLeader(name, true)
+					lockCtxs <- lockCtx
+				} else {
+					logger.Debug("holder renewed", "deadline", deadline, "latency", latency)
+				}
+			} else {
+				lose("not acquired")
+			}
+			nextUpdateChan = clock.After(o.renewDelay(ttl))
+
+		case <-expireChan:
+			expireChan = nil
+			lose("expired")
+
+		case <-ctx.Done():
+			func() {
+				releaseCtx, cancel := context.WithTimeout(context.Background(), o.releaseTimeout)
+				defer cancel()
+				if err := release(releaseCtx); err != nil {
+					logger.Warn("release failed", "error", err)
+					if onError != nil {
+						onError(err)
+					}
+				} else {
+					logger.Info("holder released")
+				}
+			}()
+			return
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package ydb_locker
+
+import (
+	"context"
+	"log/slog"
+)
+
+// discardHandler drops every record, so libraries embedding the locker stay quiet unless a logger is set.
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+var nopLogger = slog.New(discardHandler{})
+
+func loggerOrNop(logger *slog.Logger) *slog.Logger {
+	if logger == nil {
+		return nopLogger
+	}
+	return logger
+}
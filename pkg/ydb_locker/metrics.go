@@ -0,0 +1,35 @@
+package ydb_locker
+
+import "time"
+
+// Metrics is notified by the locker loop and by YdbLockStorage, implementations must be safe for concurrent use.
+type Metrics interface {
+	// LockAcquired is called when the owner takes the lock it did not hold before.
+	LockAcquired(lockName string)
+	// LockLost is called when the owner stops holding the lock: taken over, expired or released.
+	LockLost(lockName string)
+	// SetLeader reports whether the owner currently holds the lock.
+	SetLeader(lockName string, isLeader bool)
+	// LockRenewed reports the latency of every TryLock made by the renewal loop, err is its result.
+	LockRenewed(lockName string, latency time.Duration, err error)
+	// ExecutedUnderLock reports how long a function passed to ExecuteUnderLock ran.
+	ExecutedUnderLock(lockName string, duration time.Duration, err error)
+	// StorageRequest reports a single storage request, op is one of "create", "try_lock", "release", "get", "set_metadata", "execute_guarded".
+	StorageRequest(op string, lockName string, latency time.Duration, err error)
+}
+
+type NopMetrics struct{}
+
+func (NopMetrics) LockAcquired(string)                                 {}
+func (NopMetrics) LockLost(string)                                     {}
+func (NopMetrics) SetLeader(string, bool)                              {}
+func (NopMetrics) LockRenewed(string, time.Duration, error)            {}
+func (NopMetrics) ExecutedUnderLock(string, time.Duration, error)      {}
+func (NopMetrics) StorageRequest(string, string, time.Duration, error) {}
+
+func metricsOrNop(metrics Metrics) Metrics {
+	if metrics == nil {
+		return NopMetrics{}
+	}
+	return metrics
+}
@@ -0,0 +1,62 @@
+package ydb_locker
+
+import (
+	"context"
+	"time"
+)
+
+// Mutex adapts Locker to sync.Locker. The lock is renewed in the background while it is held,
+// but sync.Locker has no way to report a lost lease: code that cares should use Locker.Acquire instead.
+// Every Mutex needs its own owner name, two mutexes of the same owner would both get the lock.
+type Mutex struct {
+	Locker *Locker
+
+	// sem serialises holders within the process, they all share the same owner name in the storage.
+	sem   chan struct{}
+	lease *Lease
+}
+
+func NewMutex(lockStorage LockStorage, lockName string, ownerName string, ttl time.Duration, opts ...LockerOption) *Mutex {
+	return &Mutex{
+		Locker: NewLocker(lockStorage, lockName, ownerName, ttl, opts...),
+		sem:    make(chan struct{}, 1),
+	}
+}
+
+// Lock blocks until the lock is acquired, storage errors are passed to Locker.OnError and retried.
+func (m *Mutex) Lock() {
+	for m.LockContext(context.Background()) != nil {
+	}
+}
+
+// LockContext blocks until the lock is acquired or ctx is done.
+func (m *Mutex) LockContext(ctx context.Context) error {
+	select {
+	case m.sem <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	lease, err := m.Locker.Acquire(ctx)
+	if err != nil {
+		<-m.sem
+		return err
+	}
+	m.lease = lease
+	return nil
+}
+
+// Unlock releases the lock, a release error is passed to Locker.OnError: the lease expires on its own anyway.
+func (m *Mutex) Unlock() {
+	lease := m.lease
+	if lease == nil {
+		panic("ydb_locker: unlock of unlocked mutex")
+	}
+	m.lease = nil
+	defer func() { <-m.sem }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.Locker.opts().releaseTimeout)
+	defer cancel()
+	if err := lease.Release(ctx); err != nil && m.Locker.OnError != nil {
+		m.Locker.OnError(err)
+	}
+}
@@ -0,0 +1,66 @@
+package ydb_locker
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+var _ sync.Locker = (*Mutex)(nil)
+
+func TestLocalMutex(t *testing.T) {
+	storage := NewLocalLockStorage()
+	var locks []sync.Locker
+	for _, owner := range []string{"owner1", "owner2", "owner3"} {
+		locks = append(locks, NewMutex(storage, "lock1", owner, time.Second))
+	}
+	locks = append(locks, locks[0])
+
+	var wg sync.WaitGroup
+	var inside, total int
+	var mu sync.Mutex
+	for _, l := range locks {
+		wg.Add(1)
+		go func(l sync.Locker) {
+			defer wg.Done()
+			for i := 0; i < 3; i++ {
+				l.Lock()
+				mu.Lock()
+				inside++
+				if inside != 1 {
+					t.Errorf("%d holders inside the mutex", inside)
+				}
+				total++
+				mu.Unlock()
+				time.Sleep(time.Millisecond * 10)
+				mu.Lock()
+				inside--
+				mu.Unlock()
+				l.Unlock()
+			}
+		}(l)
+	}
+	wg.Wait()
+	if total != 12 {
+		t.Errorf("expected 12 critical sections, got %d", total)
+	}
+}
+
+func TestLocalMutexLockContext(t *testing.T) {
+	storage := NewLocalLockStorage()
+	m1 := NewMutex(storage, "lock1", "owner1", time.Second*10)
+	m2 := NewMutex(storage, "lock1", "owner2", time.Second*10)
+
+	m1.Lock()
+	ctx100ms, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	if err := m2.LockContext(ctx100ms); err == nil {
+		t.Fatal("mutex is locked by two owners")
+	}
+	m1.Unlock()
+	if err := m2.LockContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	m2.Unlock()
+}
@@ -0,0 +1,274 @@
+package ydb_locker
+
+import (
+	"github.com/jonboulle/clockwork"
+	"log/slog"
+	"math/rand"
+	"time"
+)
+
+const (
+	defaultReleaseTimeout          = 3 * time.Second
+	defaultEventBufferSize         = 100
+	defaultFuncsToRunBufferSize    = 1000
+	defaultMaxConcurrentExecutions = 1
+
+	defaultCreateLockAttempts      = 10
+	defaultCreateLockInitialDelay  = 100 * time.Millisecond
+	defaultCreateLockMaxRetryDelay = 10 * time.Second
+	defaultAcquireInitialDelay     = 100 * time.Millisecond
+	defaultAcquireMaxRetryDelay    = 5 * time.Second
+)
+
+// RenewIntervalFunc returns the base delay between two renewals of a lock with the given ttl.
+type RenewIntervalFunc func(ttl time.Duration) time.Duration
+
+// DefaultRenewInterval renews ten times per ttl.
+func DefaultRenewInterval(ttl time.Duration) time.Duration {
+	return ttl / 10
+}
+
+type lockerOptions struct {
+	renewInterval           RenewIntervalFunc
+	renewJitter             float64
+	releaseTimeout          time.Duration
+	pollInterval            time.Duration
+	safetyMargin            time.Duration
+	clock                   clockwork.Clock
+	eventBufferSize         int
+	funcsToRunBufferSize    int
+	maxConcurrentExecutions int
+	stepDownOnPanic         bool
+	createLockRetries       backoff
+	acquireBackoff          backoff
+
+	// The hooks below are only read by LockerThread and LockerContext,
+	// a Locker takes them from its fields of the same name.
+	onError  func(error)
+	logger   *slog.Logger
+	metrics  Metrics
+	notify   func(LockEvent)
+	metadata func() []byte
+}
+
+// backoff is an exponential retry delay: initial, doubled after every attempt up to max.
+type backoff struct {
+	attempts int
+	initial  time.Duration
+	max      time.Duration
+}
+
+// newBackoff replaces the delays of current that are not positive with its own, a zero delay would retry in a hot loop.
+func newBackoff(attempts int, initial time.Duration, maxDelay time.Duration, current backoff) backoff {
+	if initial <= 0 {
+		initial = current.initial
+	}
+	if maxDelay <= 0 {
+		maxDelay = current.max
+	}
+	return backoff{attempts: attempts, initial: initial, max: max(maxDelay, initial)}
+}
+
+func (b backoff) next(delay time.Duration) time.Duration {
+	return min(delay*2, b.max)
+}
+
+// LockerOption configures a Locker, see NewLocker.
+type LockerOption func(*lockerOptions)
+
+func defaultLockerOptions() *lockerOptions {
+	return &lockerOptions{
+		renewInterval:           DefaultRenewInterval,
+		renewJitter:             1,
+		releaseTimeout:          defaultReleaseTimeout,
+		clock:                   clockwork.NewRealClock(),
+		eventBufferSize:         defaultEventBufferSize,
+		funcsToRunBufferSize:    defaultFuncsToRunBufferSize,
+		maxConcurrentExecutions: defaultMaxConcurrentExecutions,
+		createLockRetries:       backoff{attempts: defaultCreateLockAttempts, initial: defaultCreateLockInitialDelay, max: defaultCreateLockMaxRetryDelay},
+		acquireBackoff:          backoff{initial: defaultAcquireInitialDelay, max: defaultAcquireMaxRetryDelay},
+	}
+}
+
+func newLockerOptions(opts ...LockerOption) *lockerOptions {
+	o := defaultLockerOptions()
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithRenewInterval sets the strategy of the delay between renewals, DefaultRenewInterval by default.
+// DefaultRenewInterval is used as well where f returns no positive delay.
+func WithRenewInterval(f RenewIntervalFunc) LockerOption {
+	return func(o *lockerOptions) {
+		o.renewInterval = f
+	}
+}
+
+// WithRenewJitter adds a random delay of up to jitter*interval to every renewal and poll, 1 by default.
+func WithRenewJitter(jitter float64) LockerOption {
+	return func(o *lockerOptions) {
+		o.renewJitter = jitter
+	}
+}
+
+// WithReleaseTimeout bounds the release request made when the locker stops, 3 seconds by default.
+func WithReleaseTimeout(timeout time.Duration) LockerOption {
+	return func(o *lockerOptions) {
+		o.releaseTimeout = timeout
+	}
+}
+
+// WithAcquirePollInterval sets how often an owner that does not hold the lock asks for it.
+// By default it polls at the renew interval, and Acquire backs off exponentially.
+func WithAcquirePollInterval(interval time.Duration) LockerOption {
+	return func(o *lockerOptions) {
+		o.pollInterval = interval
+	}
+}
+
+// WithSafetyMargin makes lease contexts end margin before the deadline stored in the lock,
+// leaving room for clock skew between the process and the storage. A margin over half of the ttl is cut to half of it.
+func WithSafetyMargin(margin time.Duration) LockerOption {
+	return func(o *lockerOptions) {
+		o.safetyMargin = margin
+	}
+}
+
+// WithClock replaces the real clock, mostly for tests.
+func WithClock(clock clockwork.Clock) LockerOption {
+	return func(o *lockerOptions) {
+		o.clock = clock
+	}
+}
+
+// WithEventBufferSize sets the buffer of lock event channels, both internal and returned by Subscribe, 100 by default.
+func WithEventBufferSize(size int) LockerOption {
+	return func(o *lockerOptions) {
+		o.eventBufferSize = size
+	}
+}
+
+// WithFuncsToRunBufferSize sets the buffer of Locker.FuncsToRun, 1000 by default.
+func WithFuncsToRunBufferSize(size int) LockerOption {
+	return func(o *lockerOptions) {
+		o.funcsToRunBufferSize = size
+	}
+}
+
+// WithMaxConcurrentExecutions caps how many functions from FuncsToRun, i.e. ExecuteUnderLock calls, run at once.
+// By default they run one at a time, in the order they were queued.
+// Values below 1 mean 1, without workers every call would wait until its context is done.
+func WithMaxConcurrentExecutions(n int) LockerOption {
+	return func(o *lockerOptions) {
+		o.maxConcurrentExecutions = max(n, 1)
+	}
+}
+
+// WithStepDownOnPanic makes the locker give the lock up when a function run under it panics:
+// the LockerContext run stops and Err returns the *PanicError. By default the locker keeps the lock.
+func WithStepDownOnPanic() LockerOption {
+	return func(o *lockerOptions) {
+		o.stepDownOnPanic = true
+	}
+}
+
+// WithCreateLockRetries sets how many times the lock row creation is attempted before the locker fails for good,
+// 10 by default, and the backoff between the attempts, from 100ms doubling up to 10s by default.
+// Attempts below 1 mean a single attempt, a delay that is not positive keeps the default one.
+func WithCreateLockRetries(attempts int, initialDelay time.Duration, maxDelay time.Duration) LockerOption {
+	return func(o *lockerOptions) {
+		o.createLockRetries = newBackoff(max(attempts, 1), initialDelay, maxDelay, o.createLockRetries)
+	}
+}
+
+// WithAcquireBackoff sets the backoff of Acquire polling a busy lock, from 100ms doubling up to 5s by default.
+// WithAcquirePollInterval takes precedence over it. A delay that is not positive keeps the default one.
+func WithAcquireBackoff(initialDelay time.Duration, maxDelay time.Duration) LockerOption {
+	return func(o *lockerOptions) {
+		o.acquireBackoff = newBackoff(0, initialDelay, maxDelay, o.acquireBackoff)
+	}
+}
+
+// WithOnError sets the receiver of every locker error, see Locker.OnError.
+func WithOnError(onError func(error)) LockerOption {
+	return func(o *lockerOptions) {
+		o.onError = onError
+	}
+}
+
+// WithLogger sets the logger of lock lifecycle events, see Locker.Logger.
+func WithLogger(logger *slog.Logger) LockerOption {
+	return func(o *lockerOptions) {
+		o.logger = logger
+	}
+}
+
+// WithMetrics sets the metrics of the locker, see Locker.Metrics.
+func WithMetrics(metrics Metrics) LockerOption {
+	return func(o *lockerOptions) {
+		o.metrics = metrics
+	}
+}
+
+// WithEventNotify makes LockerContext pass every lock event to notify, a Locker uses Subscribe instead.
+func WithEventNotify(notify func(LockEvent)) LockerOption {
+	return func(o *lockerOptions) {
+		o.notify = notify
+	}
+}
+
+// WithMetadata makes LockerThread publish metadata() on every acquisition, a Locker uses SetMetadata instead.
+func WithMetadata(metadata func() []byte) LockerOption {
+	return func(o *lockerOptions) {
+		o.metadata = metadata
+	}
+}
+
+// clamp fits the options to a lock with the given ttl, so that no value makes the locker spin or lose every lease at once.
+func (o *lockerOptions) clamp(ttl time.Duration) *lockerOptions {
+	renewInterval := o.renewInterval
+	o.renewInterval = func(ttl time.Duration) time.Duration {
+		if interval := renewInterval(ttl); interval > 0 {
+			return interval
+		}
+		return DefaultRenewInterval(ttl)
+	}
+	o.safetyMargin = min(o.safetyMargin, ttl/2)
+	return o
+}
+
+func (o *lockerOptions) jittered(base time.Duration) time.Duration {
+	if jitter := int64(float64(base) * o.renewJitter); jitter > 0 {
+		return base + time.Duration(rand.Int63n(jitter))
+	}
+	return base
+}
+
+func (o *lockerOptions) renewDelay(ttl time.Duration) time.Duration {
+	return o.jittered(o.renewInterval(ttl))
+}
+
+// pollDelay is the delay before the next attempt of an owner that does not hold the lock.
+func (o *lockerOptions) pollDelay(ttl time.Duration) time.Duration {
+	if o.pollInterval > 0 {
+		return o.jittered(o.pollInterval)
+	}
+	return o.renewDelay(ttl)
+}
+
+// renewTimeout bounds a single TryLock: a holder has to succeed before its lease ends, anybody else gets a ttl.
+func (o *lockerOptions) renewTimeout(ttl time.Duration, deadline time.Time, held bool) time.Duration {
+	if held {
+		if timeout := o.leaseEnd(deadline).Sub(o.clock.Now()); timeout > 0 {
+			return timeout
+		}
+	}
+	return ttl
+}
+
+// leaseEnd is the moment a lease with the given storage deadline is considered over locally.
+func (o *lockerOptions) leaseEnd(deadline time.Time) time.Time {
+	return deadline.Add(-o.safetyMargin)
+}
@@ -0,0 +1,44 @@
+package ydb_locker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockerOptions(t *testing.T) {
+	ttl := time.Second * 10
+	zeroInterval := func(time.Duration) time.Duration { return 0 }
+	for _, tc := range []struct {
+		name   string
+		opts   []LockerOption
+		check  func(o *lockerOptions) bool
+		expect string
+	}{
+		{"default renew interval", nil,
+			func(o *lockerOptions) bool { return o.renewInterval(ttl) == time.Second }, "ttl/10"},
+		{"zero renew interval", []LockerOption{WithRenewInterval(zeroInterval)},
+			func(o *lockerOptions) bool { return o.renewInterval(ttl) == time.Second }, "the default interval"},
+		{"safety margin over half of the ttl", []LockerOption{WithSafetyMargin(ttl)},
+			func(o *lockerOptions) bool { return o.safetyMargin == ttl/2 }, "half of the ttl"},
+		{"safety margin", []LockerOption{WithSafetyMargin(time.Second * 2)},
+			func(o *lockerOptions) bool { return o.safetyMargin == time.Second*2 }, "2s"},
+		{"no workers", []LockerOption{WithMaxConcurrentExecutions(0)},
+			func(o *lockerOptions) bool { return o.maxConcurrentExecutions == 1 }, "one worker"},
+		{"funcs to run buffer", []LockerOption{WithFuncsToRunBufferSize(5)},
+			func(o *lockerOptions) bool { return o.funcsToRunBufferSize == 5 }, "5"},
+		{"event buffer", []LockerOption{WithEventBufferSize(7)},
+			func(o *lockerOptions) bool { return o.eventBufferSize == 7 }, "7"},
+		{"no create lock attempts", []LockerOption{WithCreateLockRetries(0, 0, 0)},
+			func(o *lockerOptions) bool {
+				return o.createLockRetries == backoff{attempts: 1, initial: defaultCreateLockInitialDelay, max: defaultCreateLockMaxRetryDelay}
+			}, "a single attempt with the default delays"},
+		{"acquire backoff below its initial delay", []LockerOption{WithAcquireBackoff(time.Second, time.Millisecond)},
+			func(o *lockerOptions) bool {
+				return o.acquireBackoff == backoff{initial: time.Second, max: time.Second}
+			}, "capped by the initial delay"},
+	} {
+		if o := newLockerOptions(tc.opts...).clamp(ttl); !tc.check(o) {
+			t.Errorf("%s: expected %s, got %+v", tc.name, tc.expect, o)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package ydb_locker
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var DefaultLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// metricFamily keeps values of a single metric keyed by the rendered label set, e.g. `lock="lock1"`.
+type metricFamily struct {
+	name       string
+	help       string
+	kind       string
+	values     map[string]float64
+	histograms map[string]*histogram
+}
+
+// PrometheusMetrics implements Metrics and serves the collected values in the Prometheus text format.
+type PrometheusMetrics struct {
+	buckets []float64
+
+	mu              sync.Mutex
+	acquisitions    *metricFamily
+	losses          *metricFamily
+	leader          *metricFamily
+	renewLatency    *metricFamily
+	renewErrors     *metricFamily
+	executeDuration *metricFamily
+	executeErrors   *metricFamily
+	storageLatency  *metricFamily
+	storageErrors   *metricFamily
+}
+
+func NewPrometheusMetrics() *PrometheusMetrics {
+	return NewPrometheusMetricsWithBuckets(DefaultLatencyBuckets)
+}
+
+func NewPrometheusMetricsWithBuckets(buckets []float64) *PrometheusMetrics {
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	family := func(name string, kind string, help string) *metricFamily {
+		return &metricFamily{
+			name:       name,
+			help:       help,
+			kind:       kind,
+			values:     make(map[string]float64),
+			histograms: make(map[string]*histogram),
+		}
+	}
+	return &PrometheusMetrics{
+		buckets:         buckets,
+		acquisitions:    family("ydb_locker_acquisitions_total", "counter", "Number of times the lock was acquired."),
+		losses:          family("ydb_locker_losses_total", "counter", "Number of times the lock was lost or released."),
+		leader:          family("ydb_locker_is_leader", "gauge", "1 if this process currently holds the lock."),
+		renewLatency:    family("ydb_locker_renew_latency_seconds", "histogram", "Latency of lock renewals."),
+		renewErrors:     family("ydb_locker_renew_errors_total", "counter", "Number of failed lock renewals."),
+		executeDuration: family("ydb_locker_execute_under_lock_duration_seconds", "histogram", "Duration of functions executed under the lock."),
+		executeErrors:   family("ydb_locker_execute_under_lock_errors_total", "counter", "Number of functions executed under the lock that returned an error."),
+		storageLatency:  family("ydb_locker_storage_request_latency_seconds", "histogram", "Latency of storage requests."),
+		storageErrors:   family("ydb_locker_storage_request_errors_total", "counter", "Number of failed storage requests."),
+	}
+}
+
+func escapeLabelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func lockLabels(lockName string) string {
+	return fmt.Sprintf(`lock="%s"`, escapeLabelValue(lockName))
+}
+
+func (m *PrometheusMetrics) add(f *metricFamily, labels string, v float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f.values[labels] += v
+}
+
+func (m *PrometheusMetrics) set(f *metricFamily, labels string, v float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f.values[labels] = v
+}
+
+func (m *PrometheusMetrics) observe(f *metricFamily, labels string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := f.histograms[labels]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(m.buckets))}
+		f.histograms[labels] = h
+	}
+	v := d.Seconds()
+	for i, bound := range m.buckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (m *PrometheusMetrics) LockAcquired(lockName string) {
+	m.add(m.acquisitions, lockLabels(lockName), 1)
+}
+
+func (m *PrometheusMetrics) LockLost(lockName string) {
+	m.add(m.losses, lockLabels(lockName), 1)
+}
+
+func (m *PrometheusMetrics) SetLeader(lockName string, isLeader bool) {
+	v := 0.0
+	if isLeader {
+		v = 1
+	}
+	m.set(m.leader, lockLabels(lockName), v)
+}
+
+func (m *PrometheusMetrics) LockRenewed(lockName string, latency time.Duration, err error) {
+	m.observe(m.renewLatency, lockLabels(lockName), latency)
+	if err != nil {
+		m.add(m.renewErrors, lockLabels(lockName), 1)
+	}
+}
+
+func (m *PrometheusMetrics) ExecutedUnderLock(lockName string, duration time.Duration, err error) {
+	m.observe(m.executeDuration, lockLabels(lockName), duration)
+	if err != nil {
+		m.add(m.executeErrors, lockLabels(lockName), 1)
+	}
+}
+
+func (m *PrometheusMetrics) StorageRequest(op string, lockName string, latency time.Duration, err error) {
+	labels := fmt.Sprintf(`op="%s",%s`, escapeLabelValue(op), lockLabels(lockName))
+	m.observe(m.storageLatency, labels, latency)
+	if err != nil {
+		m.add(m.storageErrors, labels, 1)
+	}
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (m *PrometheusMetrics) writeFamily(w io.Writer, f *metricFamily) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+	for _, labels := range sortedKeys(f.values) {
+		fmt.Fprintf(w, "%s{%s} %s\n", f.name, labels, formatFloat(f.values[labels]))
+	}
+	for _, labels := range sortedKeys(f.histograms) {
+		h := f.histograms[labels]
+		for i, bound := range m.buckets {
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", f.name, labels, formatFloat(bound), h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", f.name, labels, h.count)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", f.name, labels, formatFloat(h.sum))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", f.name, labels, h.count)
+	}
+}
+
+// WriteText writes all metrics in the Prometheus text exposition format.
+func (m *PrometheusMetrics) WriteText(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, f := range []*metricFamily{
+		m.acquisitions, m.losses, m.leader, m.renewLatency, m.renewErrors,
+		m.executeDuration, m.executeErrors, m.storageLatency, m.storageErrors,
+	} {
+		m.writeFamily(w, f)
+	}
+}
+
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteText(w)
+}
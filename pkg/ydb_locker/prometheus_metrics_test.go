@@ -0,0 +1,50 @@
+package ydb_locker
+
+import (
+	"context"
+	"errors"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheusMetricsLocalLocker(t *testing.T) {
+	ctx := context.Background()
+	metrics := NewPrometheusMetrics()
+	locker := NewLocker(NewLocalLockStorage(), "lock1", "owner1", time.Second*10)
+	locker.Metrics = metrics
+
+	lockerCtx, cancel := context.WithCancel(ctx)
+	lockCtxs := locker.LockerContext(lockerCtx)
+	lockCtx := <-lockCtxs
+	locker.ExecuteUnderLock(lockCtx, func(context.Context, table.Session, table.Transaction) error {
+		return nil
+	})
+	cancel()
+	for range lockCtxs {
+	}
+	metrics.StorageRequest("try_lock", `lo"ck`, time.Millisecond*20, errors.New("unavailable"))
+
+	rec := httptest.NewRecorder()
+	metrics.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Result().Body)
+	out := string(body)
+
+	for _, expected := range []string{
+		"# TYPE ydb_locker_acquisitions_total counter\nydb_locker_acquisitions_total{lock=\"lock1\"} 1\n",
+		"ydb_locker_losses_total{lock=\"lock1\"} 1\n",
+		"ydb_locker_is_leader{lock=\"lock1\"} 0\n",
+		"ydb_locker_renew_latency_seconds_count{lock=\"lock1\"} 1\n",
+		"ydb_locker_execute_under_lock_duration_seconds_count{lock=\"lock1\"} 1\n",
+		"ydb_locker_storage_request_latency_seconds_bucket{op=\"try_lock\",lock=\"lo\\\"ck\",le=\"0.01\"} 0\n",
+		"ydb_locker_storage_request_latency_seconds_bucket{op=\"try_lock\",lock=\"lo\\\"ck\",le=\"0.025\"} 1\n",
+		"ydb_locker_storage_request_errors_total{op=\"try_lock\",lock=\"lo\\\"ck\"} 1\n",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected %q in metrics output:\n%s", expected, out)
+		}
+	}
+}
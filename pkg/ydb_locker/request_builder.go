@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/ydb-platform/ydb-go-sdk/v3/table"
 	"github.com/ydb-platform/ydb-go-sdk/v3/table/types"
+	"strings"
 	"time"
 )
 
@@ -11,21 +12,53 @@ type LockRequestBuilder interface {
 	GetLockNameColumnName() string
 	GetOwnerColumnName() string
 	GetDeadlineColumnName() string
+	GetGenerationColumnName() string
+	GetMetadataColumnName() string
 
+	// GetSelectLockQueryWithParams selects the lock columns together with the same "alive" flag
+	// as GetCheckLeaseQueryWithParams.
 	GetSelectLockQueryWithParams(lockName string) (string, *table.QueryParameters)
+	// GetCheckLeaseQueryWithParams selects the owner and generation of the lock together with
+	// an "alive" flag that is true while the deadline has not passed by the server clock.
+	GetCheckLeaseQueryWithParams(lockName string) (string, *table.QueryParameters)
 	GetUpdateLockQueryWithParams(lockName string, owner string, ttl time.Duration) (string, *table.QueryParameters)
 	GetCreateLockQueryWithParams(lockName string) (string, *table.QueryParameters)
+	GetReleaseLockQueryWithParams(lockName string, owner string) (string, *table.QueryParameters)
+	GetSetMetadataQueryWithParams(lockName string, owner string, metadata []byte) (string, *table.QueryParameters)
+	// GetGuardedQueryWithParams wraps a user query so that it fails with LockGuardMessage unless owner holds
+	// a live lease of the lock with the given generation, 0 matches any. The params are merged with the guard ones.
+	GetGuardedQueryWithParams(lockName string, owner string, generation uint64, query string, params *table.QueryParameters) (string, *table.QueryParameters)
 }
 
+// LockGuardMessage is the message a guarded query fails with when the caller does not hold the lock.
+const LockGuardMessage = "lock guard: not the lock holder"
+
 type LockSchemaRequestBuilder interface {
 	GetCreateLocksTableQuery() string
 }
 
+// LockSchemaMigrationRequestBuilder is implemented by schema builders whose table gained columns since
+// its first version, CreateLocksTable uses it to add them to a table created before.
+type LockSchemaMigrationRequestBuilder interface {
+	GetLocksTableMigrations() []ColumnMigration
+}
+
+// ColumnMigration adds a column to an existing table: CheckQuery fails if the column is missing, AddQuery adds it.
+type ColumnMigration struct {
+	CheckQuery string
+	AddQuery   string
+}
+
 type LockRequestBuilderImpl struct {
 	TableName          string
 	LockNameColumnName string
 	OwnerColumnName    string
 	DeadlineColumnName string
+	// GenerationColumnName may be left empty for tables created before the column existed,
+	// the fencing generation is always 0 then and is not checked.
+	GenerationColumnName string
+	// MetadataColumnName may be left empty as well, SetMetadata fails with ErrNoMetadataColumn then.
+	MetadataColumnName string
 }
 
 func (l *LockRequestBuilderImpl) GetLockNameColumnName() string {
@@ -40,11 +73,38 @@ func (l *LockRequestBuilderImpl) GetDeadlineColumnName() string {
 	return l.DeadlineColumnName
 }
 
+func (l *LockRequestBuilderImpl) GetGenerationColumnName() string {
+	return l.GenerationColumnName
+}
+
+func (l *LockRequestBuilderImpl) GetMetadataColumnName() string {
+	return l.MetadataColumnName
+}
+
+// columns joins the names of the configured columns, optional ones left empty are skipped.
+func columns(names ...string) string {
+	configured := make([]string, 0, len(names))
+	for _, name := range names {
+		if name != "" {
+			configured = append(configured, name)
+		}
+	}
+	return strings.Join(configured, ", ")
+}
+
 func (l *LockRequestBuilderImpl) GetSelectLockQueryWithParams(lockName string) (string, *table.QueryParameters) {
 	return fmt.Sprintf(
 			`DECLARE $LOCK_NAME AS Utf8;
-			SELECT %[3]s FROM %[1]s WHERE %[2]s = $LOCK_NAME`,
-			l.TableName, l.LockNameColumnName, l.OwnerColumnName, l.DeadlineColumnName),
+			SELECT %[3]s, (%[4]s > CurrentUtcTimestamp()) ?? false AS alive FROM %[1]s WHERE %[2]s = $LOCK_NAME`,
+			l.TableName, l.LockNameColumnName, columns(l.OwnerColumnName, l.DeadlineColumnName, l.GenerationColumnName, l.MetadataColumnName), l.DeadlineColumnName),
+		table.NewQueryParameters(table.ValueParam("$LOCK_NAME", types.UTF8Value(lockName)))
+}
+
+func (l *LockRequestBuilderImpl) GetCheckLeaseQueryWithParams(lockName string) (string, *table.QueryParameters) {
+	return fmt.Sprintf(
+			`DECLARE $LOCK_NAME AS Utf8;
+			SELECT %[3]s, (%[4]s > CurrentUtcTimestamp()) ?? false AS alive FROM %[1]s WHERE %[2]s = $LOCK_NAME`,
+			l.TableName, l.LockNameColumnName, columns(l.OwnerColumnName, l.GenerationColumnName), l.DeadlineColumnName),
 		table.NewQueryParameters(table.ValueParam("$LOCK_NAME", types.UTF8Value(lockName)))
 }
 
@@ -54,6 +114,19 @@ func (l *LockRequestBuilderImpl) GetUpdateLockQueryWithParams(lockName string, o
 	// elif CurrentUtcTimestamp() > deadline:
 	//		deadline = CurrentUtcTimestamp() + TTL
 	//      owner = $owner
+	//      generation = generation + 1
+	//      metadata = NULL
+	generation, metadata := "", ""
+	if l.GenerationColumnName != "" {
+		generation = fmt.Sprintf(`,
+				if(%[1]s == $OWNER, %[3]s ?? 0ul, if($ts >= %[2]s ?? $ts, (%[3]s ?? 0ul) + 1ul, %[3]s ?? 0ul)) as %[3]s`,
+			l.OwnerColumnName, l.DeadlineColumnName, l.GenerationColumnName)
+	}
+	if l.MetadataColumnName != "" {
+		metadata = fmt.Sprintf(`,
+				if(%[1]s == $OWNER, %[3]s, if($ts >= %[2]s ?? $ts, NULL, %[3]s)) as %[3]s`,
+			l.OwnerColumnName, l.DeadlineColumnName, l.MetadataColumnName)
+	}
 	return fmt.Sprintf(
 			`DECLARE $LOCK_NAME AS Utf8;
 			DECLARE $OWNER AS Utf8;
@@ -66,14 +139,15 @@ func (l *LockRequestBuilderImpl) GetUpdateLockQueryWithParams(lockName string, o
 			select
 				%[2]s,
 				if(%[3]s == $OWNER, %[3]s, if($ts >= %[4]s ?? $ts, $OWNER, %[3]s)) as %[3]s,
-				if(%[3]s == $OWNER, $new_ts, if($ts >= %[4]s ?? $ts, $new_ts, %[4]s)) as %[4]s
+				if(%[3]s == $OWNER, $new_ts, if($ts >= %[4]s ?? $ts, $new_ts, %[4]s)) as %[4]s%[5]s%[6]s
 			from %[1]s
 			where %[2]s == $LOCK_NAME;
 
-			select %[3]s, %[4]s
+			select %[7]s
 			from %[1]s
 			where %[2]s == $LOCK_NAME;
-		`, l.TableName, l.LockNameColumnName, l.OwnerColumnName, l.DeadlineColumnName),
+		`, l.TableName, l.LockNameColumnName, l.OwnerColumnName, l.DeadlineColumnName, generation, metadata,
+			columns(l.OwnerColumnName, l.DeadlineColumnName, l.GenerationColumnName)),
 		table.NewQueryParameters(
 			table.ValueParam("$LOCK_NAME", types.UTF8Value(lockName)),
 			table.ValueParam("$OWNER", types.UTF8Value(owner)),
@@ -82,31 +156,154 @@ func (l *LockRequestBuilderImpl) GetUpdateLockQueryWithParams(lockName string, o
 }
 
 func (l *LockRequestBuilderImpl) GetCreateLockQueryWithParams(lockName string) (string, *table.QueryParameters) {
+	generation := ""
+	if l.GenerationColumnName != "" {
+		generation = ", 0ul"
+	}
 	return fmt.Sprintf(
 			`DECLARE $LOCK_NAME AS Utf8;
 			INSERT INTO %[1]s
-			(%[2]s, %[3]s, %[4]s)
-			VALUES ($LOCK_NAME, '', CurrentUtcTimeStamp());`,
-			l.TableName, l.LockNameColumnName, l.OwnerColumnName, l.DeadlineColumnName),
+			(%[2]s)
+			VALUES ($LOCK_NAME, '', CurrentUtcTimeStamp()%[3]s);`,
+			l.TableName, columns(l.LockNameColumnName, l.OwnerColumnName, l.DeadlineColumnName, l.GenerationColumnName), generation),
 		table.NewQueryParameters(table.ValueParam("$LOCK_NAME", types.UTF8Value(lockName)))
 }
 
+func (l *LockRequestBuilderImpl) GetReleaseLockQueryWithParams(lockName string, owner string) (string, *table.QueryParameters) {
+	// released = owner == $owner && deadline > CurrentUtcTimestamp(), no row if the lock does not exist
+	// if owner == $owner:
+	//		owner = ''
+	//		deadline = CurrentUtcTimestamp()
+	//		metadata = NULL
+	metadata := ""
+	if l.MetadataColumnName != "" {
+		metadata = fmt.Sprintf(", %s = NULL", l.MetadataColumnName)
+	}
+	return fmt.Sprintf(
+			`DECLARE $LOCK_NAME AS Utf8;
+			DECLARE $OWNER AS Utf8;
+
+			$ts = CurrentUtcTimestamp();
+
+			select coalesce(%[3]s == $OWNER and %[4]s > $ts, false) as released
+			from %[1]s
+			where %[2]s == $LOCK_NAME;
+
+			update %[1]s
+			set %[3]s = ''u, %[4]s = $ts%[5]s
+			where %[2]s == $LOCK_NAME and %[3]s == $OWNER;
+		`, l.TableName, l.LockNameColumnName, l.OwnerColumnName, l.DeadlineColumnName, metadata),
+		table.NewQueryParameters(
+			table.ValueParam("$LOCK_NAME", types.UTF8Value(lockName)),
+			table.ValueParam("$OWNER", types.UTF8Value(owner)),
+		)
+}
+
+func (l *LockRequestBuilderImpl) GetSetMetadataQueryWithParams(lockName string, owner string, metadata []byte) (string, *table.QueryParameters) {
+	// updated = owner == $owner && deadline > CurrentUtcTimestamp(), no row if the lock does not exist
+	// if updated:
+	//		metadata = $metadata
+	return fmt.Sprintf(
+			`DECLARE $LOCK_NAME AS Utf8;
+			DECLARE $OWNER AS Utf8;
+			DECLARE $METADATA AS String;
+
+			$ts = CurrentUtcTimestamp();
+
+			select coalesce(%[3]s == $OWNER and %[4]s > $ts, false) as updated
+			from %[1]s
+			where %[2]s == $LOCK_NAME;
+
+			update %[1]s
+			set %[5]s = $METADATA
+			where %[2]s == $LOCK_NAME and %[3]s == $OWNER and %[4]s > $ts;
+		`, l.TableName, l.LockNameColumnName, l.OwnerColumnName, l.DeadlineColumnName, l.MetadataColumnName),
+		table.NewQueryParameters(
+			table.ValueParam("$LOCK_NAME", types.UTF8Value(lockName)),
+			table.ValueParam("$OWNER", types.UTF8Value(owner)),
+			table.ValueParam("$METADATA", types.BytesValue(metadata)),
+		)
+}
+
+func (l *LockRequestBuilderImpl) GetGuardedQueryWithParams(lockName string, owner string, generation uint64, query string, params *table.QueryParameters) (string, *table.QueryParameters) {
+	merged := table.NewQueryParameters(
+		table.ValueParam("$GUARD_LOCK_NAME", types.UTF8Value(lockName)),
+		table.ValueParam("$GUARD_OWNER", types.UTF8Value(owner)),
+	)
+	generationDeclare, generationCheck := "", ""
+	if l.GenerationColumnName != "" {
+		generationDeclare = "\n\t\t\tDECLARE $GUARD_GENERATION AS Uint64;"
+		generationCheck = fmt.Sprintf("\n\t\t\t\t\tand ($GUARD_GENERATION == 0ul or %s == $GUARD_GENERATION)", l.GenerationColumnName)
+		merged.Add(table.ValueParam("$GUARD_GENERATION", types.Uint64Value(generation)))
+	}
+	// The check runs in the same transaction as the query, a failed Ensure aborts it with all its writes.
+	guarded := fmt.Sprintf(
+		`%[1]s;
+
+			DECLARE $GUARD_LOCK_NAME AS Utf8;
+			DECLARE $GUARD_OWNER AS Utf8;%[6]s
+
+			$guard_held = (
+				select count(*) > 0ul
+				from %[2]s
+				where %[3]s == $GUARD_LOCK_NAME and %[4]s == $GUARD_OWNER and %[5]s > CurrentUtcTimestamp()%[7]s
+			);
+
+			discard select Ensure(0, $guard_held, '%[8]s');
+		`, strings.TrimRight(query, "; \t\n"), l.TableName, l.LockNameColumnName, l.OwnerColumnName, l.DeadlineColumnName,
+		generationDeclare, generationCheck, LockGuardMessage)
+
+	params.Each(func(name string, v types.Value) {
+		merged.Add(table.ValueParam(name, v))
+	})
+	return guarded, merged
+}
+
 func (l *LockRequestBuilderImpl) GetCreateLocksTableQuery() string {
+	generation, metadata := "", ""
+	if l.GenerationColumnName != "" {
+		generation = fmt.Sprintf("\n\t\t\t%s uint64,", l.GenerationColumnName)
+	}
+	if l.MetadataColumnName != "" {
+		metadata = fmt.Sprintf("\n\t\t\t%s string,", l.MetadataColumnName)
+	}
 	return fmt.Sprintf(`
 		create table if not exists %[1]s (
 			%[2]s utf8,
 			%[3]s utf8,
-			%[4]s timestamp,
+			%[4]s timestamp,%[5]s%[6]s
 			primary key (%[2]s)
 		);
-	`, "`"+l.TableName+"`", l.LockNameColumnName, l.OwnerColumnName, l.DeadlineColumnName)
+	`, "`"+l.TableName+"`", l.LockNameColumnName, l.OwnerColumnName, l.DeadlineColumnName, generation, metadata)
+}
+
+// GetLocksTableMigrations adds the generation and metadata columns, if configured, to a table created without them.
+func (l *LockRequestBuilderImpl) GetLocksTableMigrations() []ColumnMigration {
+	var migrations []ColumnMigration
+	for _, column := range []struct{ name, columnType string }{
+		{l.GenerationColumnName, "uint64"},
+		{l.MetadataColumnName, "string"},
+	} {
+		if column.name == "" {
+			continue
+		}
+		migrations = append(migrations, ColumnMigration{
+			CheckQuery: fmt.Sprintf("select %[2]s from %[1]s limit 0;", "`"+l.TableName+"`", column.name),
+			AddQuery:   fmt.Sprintf("alter table %[1]s add column %[2]s %[3]s;", "`"+l.TableName+"`", column.name, column.columnType),
+		})
+	}
+	return migrations
 }
 
+// GetDefaultRequestBuilder returns a builder for a locks table with all the columns,
+// CreateLocksTable adds the generation and metadata columns to a table created by an older version.
 func GetDefaultRequestBuilder(tableName string) *LockRequestBuilderImpl {
 	return &LockRequestBuilderImpl{
-		TableName:          tableName,
-		LockNameColumnName: "lock_name",
-		OwnerColumnName:    "owner",
-		DeadlineColumnName: "deadline",
+		TableName:            tableName,
+		LockNameColumnName:   "lock_name",
+		OwnerColumnName:      "owner",
+		DeadlineColumnName:   "deadline",
+		GenerationColumnName: "generation",
+		MetadataColumnName:   "metadata",
 	}
 }
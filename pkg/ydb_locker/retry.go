@@ -0,0 +1,179 @@
+package ydb_locker
+
+import (
+	"context"
+	"errors"
+	"github.com/ydb-platform/ydb-go-genproto/protos/Ydb"
+	"github.com/ydb-platform/ydb-go-sdk/v3"
+	"github.com/ydb-platform/ydb-go-sdk/v3/retry"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// ErrorClass is the kind of a storage error, see ClassifyError.
+type ErrorClass int
+
+const (
+	ErrorClassNone ErrorClass = iota
+	ErrorClassOverloaded
+	ErrorClassUnavailable
+	ErrorClassAborted
+	ErrorClassPreconditionFailed
+	ErrorClassSchema
+	ErrorClassCanceled
+	ErrorClassOther
+	ErrorClassRetryable
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case ErrorClassNone:
+		return "none"
+	case ErrorClassOverloaded:
+		return "overloaded"
+	case ErrorClassUnavailable:
+		return "unavailable"
+	case ErrorClassAborted:
+		return "aborted"
+	case ErrorClassPreconditionFailed:
+		return "precondition_failed"
+	case ErrorClassSchema:
+		return "schema"
+	case ErrorClassCanceled:
+		return "canceled"
+	case ErrorClassRetryable:
+		return "retryable"
+	default:
+		return "other"
+	}
+}
+
+// Retryable reports whether the SDK retries a request that failed with an error of this class.
+func (c ErrorClass) Retryable() bool {
+	switch c {
+	case ErrorClassOverloaded, ErrorClassUnavailable, ErrorClassAborted, ErrorClassRetryable:
+		return true
+	default:
+		return false
+	}
+}
+
+// ClassifyError maps an error returned by the storage to its class, ErrorClassNone for nil.
+// The SDK decides which requests are retried, the classes mirror its retry.Check for idempotent requests,
+// as all lock requests are: the errors it retries are reported as overloaded, unavailable, aborted or,
+// e.g. for BAD_SESSION and SESSION_BUSY, retryable. Transaction locks invalidated (TLI) is reported as ErrorClassAborted.
+func ClassifyError(err error) ErrorClass {
+	switch {
+	case err == nil:
+		return ErrorClassNone
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return ErrorClassCanceled
+	case errors.Is(err, ErrTableMissing), ydb.IsOperationErrorSchemeError(err):
+		return ErrorClassSchema
+	case !retry.Check(err).MustRetry(true):
+		if ydb.IsOperationError(err, Ydb.StatusIds_PRECONDITION_FAILED) {
+			return ErrorClassPreconditionFailed
+		}
+		return ErrorClassOther
+	case ydb.IsOperationErrorOverloaded(err):
+		return ErrorClassOverloaded
+	case ydb.IsOperationErrorUnavailable(err), ydb.IsTransportError(err):
+		return ErrorClassUnavailable
+	case ydb.IsOperationErrorTransactionLocksInvalidated(err), ydb.IsOperationError(err, Ydb.StatusIds_ABORTED):
+		return ErrorClassAborted
+	default:
+		return ErrorClassRetryable
+	}
+}
+
+// RetryPolicy configures the retries the SDK makes inside table.Client.Do for the lock requests of YdbLockStorage.
+// The requests are idempotent for their owner, so the SDK retries unavailability as well as overload and aborts,
+// backing off exponentially. Retries never outlive the request context: renewals are bounded by the lease deadline.
+type RetryPolicy struct {
+	// MaxAttempts bounds the attempts of a single request, values below 1 mean a single attempt.
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry, doubled after every attempt.
+	// A value that is not positive means the default one, a zero delay would retry in a hot loop.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay, a value that is not positive means no cap.
+	MaxBackoff time.Duration
+}
+
+const defaultInitialBackoff = 50 * time.Millisecond
+
+// DefaultRetryPolicy makes up to 5 attempts with the backoff from 50ms doubling up to 1s.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    5,
+		InitialBackoff: defaultInitialBackoff,
+		MaxBackoff:     time.Second,
+	}
+}
+
+// tableOptions returns the options of table.Client.Do that apply the policy to a single request.
+func (p RetryPolicy) tableOptions() []table.Option {
+	b := p.backoff()
+	return []table.Option{
+		table.WithIdempotent(),
+		table.WithRetryBudget(newAttemptsBudget(p.MaxAttempts)),
+		retryBackoffOption(b),
+	}
+}
+
+// retryBackoffOption sets the backoff of the SDK retries of table.Client.Do, the options of the retry package
+// don't apply to it directly and table.WithRetryOptions is deprecated.
+type retryBackoffOption retryBackoff
+
+func (o retryBackoffOption) ApplyTableOption(opts *table.Options) {
+	opts.RetryOptions = append(opts.RetryOptions, retry.WithFastBackoff(retryBackoff(o)), retry.WithSlowBackoff(retryBackoff(o)))
+}
+
+func (p RetryPolicy) backoff() retryBackoff {
+	b := retryBackoff{initial: p.InitialBackoff, max: p.MaxBackoff}
+	if b.initial <= 0 {
+		b.initial = defaultInitialBackoff
+	}
+	return b
+}
+
+// retryBackoff is the delay before the retry number i, counted from 0: initial doubled i times up to max.
+type retryBackoff struct {
+	initial time.Duration
+	max     time.Duration
+}
+
+func (b retryBackoff) Delay(i int) time.Duration {
+	delay := b.initial
+	for ; i > 0 && (b.max <= 0 || delay < b.max); i-- {
+		if delay > math.MaxInt64/2 {
+			return delay
+		}
+		delay *= 2
+	}
+	if b.max > 0 {
+		return min(delay, b.max)
+	}
+	return delay
+}
+
+// attemptsBudget lets a single request retry until it has made maxAttempts attempts, the SDK asks it before every retry.
+type attemptsBudget struct {
+	retries atomic.Int64
+}
+
+func newAttemptsBudget(maxAttempts int) *attemptsBudget {
+	b := &attemptsBudget{}
+	b.retries.Store(int64(max(maxAttempts, 1) - 1))
+	return b
+}
+
+func (b *attemptsBudget) Acquire(context.Context) error {
+	if b.retries.Add(-1) < 0 {
+		return errRetryAttemptsExhausted
+	}
+	return nil
+}
+
+var errRetryAttemptsExhausted = errors.New("retry attempts exhausted")
@@ -0,0 +1,205 @@
+package ydb_locker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ydb-platform/ydb-go-sdk/v3/retry"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table"
+	"testing"
+	"time"
+)
+
+func TestClassifyError(t *testing.T) {
+	for _, tc := range []struct {
+		err   error
+		class ErrorClass
+	}{
+		{nil, ErrorClassNone},
+		{fmt.Errorf("try lock: %w", context.DeadlineExceeded), ErrorClassCanceled},
+		{fmt.Errorf("%w: no such table", ErrTableMissing), ErrorClassSchema},
+		{errors.New("boom"), ErrorClassOther},
+		{retry.RetryableError(errors.New("busy")), ErrorClassRetryable},
+	} {
+		if class := ClassifyError(tc.err); class != tc.class {
+			t.Errorf("%v: expected %v, got %v", tc.err, tc.class, class)
+		}
+	}
+	if ErrorClassSchema.Retryable() || ErrorClassOther.Retryable() || !ErrorClassOverloaded.Retryable() || !ErrorClassRetryable.Retryable() {
+		t.Error("unexpected retryable classes")
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	for _, tc := range []struct {
+		policy   RetryPolicy
+		retry    int
+		expected time.Duration
+	}{
+		{DefaultRetryPolicy(), 0, time.Millisecond * 50},
+		{DefaultRetryPolicy(), 2, time.Millisecond * 200},
+		{DefaultRetryPolicy(), 10, time.Second},
+		// No cap without MaxBackoff, and no hot loop without InitialBackoff.
+		{RetryPolicy{InitialBackoff: time.Millisecond * 50}, 10, time.Millisecond * 50 << 10},
+		{RetryPolicy{}, 0, defaultInitialBackoff},
+		{RetryPolicy{InitialBackoff: -time.Second, MaxBackoff: time.Second}, 10, time.Second},
+	} {
+		if delay := tc.policy.backoff().Delay(tc.retry); delay != tc.expected {
+			t.Errorf("%+v: expected retry %d after %v, got %v", tc.policy, tc.retry, tc.expected, delay)
+		}
+	}
+}
+
+func TestRetryPolicyTableOptions(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond * 20}
+	var opts table.Options
+	for _, opt := range policy.tableOptions() {
+		opt.ApplyTableOption(&opts)
+	}
+	attempts := 0
+	start := time.Now()
+	err := retry.Retry(context.Background(), func(context.Context) error {
+		attempts++
+		return retry.RetryableError(errors.New("busy"), retry.WithBackoff(retry.TypeFastBackoff))
+	}, opts.RetryOptions...)
+	if err == nil || attempts != policy.MaxAttempts {
+		t.Errorf("expected %d failed attempts, got %d: %v", policy.MaxAttempts, attempts, err)
+	}
+	// The SDK waits 20ms and 40ms with the policy backoff, its own fast backoff would wait 15ms at most.
+	if elapsed := time.Since(start); elapsed < time.Millisecond*60 {
+		t.Errorf("expected the policy backoff, the retries took %v", elapsed)
+	}
+}
+
+func TestRetryPolicyAttempts(t *testing.T) {
+	for maxAttempts, retries := range map[int]int{0: 0, 1: 0, 5: 4} {
+		budget := newAttemptsBudget(maxAttempts)
+		allowed := 0
+		for budget.Acquire(context.Background()) == nil {
+			allowed++
+		}
+		if allowed != retries {
+			t.Errorf("expected %d retries for %d attempts, got %d", retries, maxAttempts, allowed)
+		}
+	}
+}
+
+type hangingTryLockStorage struct {
+	*LocalLockStorage
+	hanging chan struct{}
+}
+
+func (s *hangingTryLockStorage) TryLock(ctx context.Context, lockName string, ownerName string, ttl time.Duration) (string, time.Time, uint64, error) {
+	select {
+	case <-s.hanging:
+		<-ctx.Done()
+		return "", time.Time{}, 0, ctx.Err()
+	default:
+		return s.LocalLockStorage.TryLock(ctx, lockName, ownerName, ttl)
+	}
+}
+
+func TestLocalLockerCtxRenewalBoundedByLease(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	storage := &hangingTryLockStorage{NewLocalLockStorage(), make(chan struct{})}
+	locker := NewLocker(storage, "lock1", "owner1", time.Second)
+	events := locker.Subscribe(ctx)
+
+	lockCtxs := locker.LockerContext(ctx)
+	lockCtx := <-lockCtxs
+	deadline, _ := lockCtx.Deadline()
+	close(storage.hanging)
+
+	for event := range events {
+		if event.Type == EventStorageError {
+			if !errors.Is(event.Err, context.DeadlineExceeded) {
+				t.Errorf("expected the renewal to time out, got %v", event.Err)
+			}
+			if late := time.Since(deadline); late > time.Millisecond*200 {
+				t.Errorf("renewal outlived the lease by %v", late)
+			}
+			break
+		}
+	}
+	<-lockCtx.Done()
+	cancel()
+	for range lockCtxs {
+	}
+}
+
+type hangingSemaphoreStorage struct {
+	*LocalSemaphoreStorage
+	hanging chan struct{}
+}
+
+func (s *hangingSemaphoreStorage) TryAcquireSemaphore(ctx context.Context, semaphoreName string, ownerName string, limit uint64, ttl time.Duration) (bool, time.Time, error) {
+	select {
+	case <-s.hanging:
+		<-ctx.Done()
+		return false, time.Time{}, ctx.Err()
+	default:
+		return s.LocalSemaphoreStorage.TryAcquireSemaphore(ctx, semaphoreName, ownerName, limit, ttl)
+	}
+}
+
+type hangingRWLockStorage struct {
+	*LocalRWLockStorage
+	hanging chan struct{}
+}
+
+func (s *hangingRWLockStorage) TryReadLock(ctx context.Context, lockName string, ownerName string, ttl time.Duration) (bool, time.Time, error) {
+	select {
+	case <-s.hanging:
+		<-ctx.Done()
+		return false, time.Time{}, ctx.Err()
+	default:
+		return s.LocalRWLockStorage.TryReadLock(ctx, lockName, ownerName, ttl)
+	}
+}
+
+func (s *hangingRWLockStorage) TryWriteLock(ctx context.Context, lockName string, ownerName string, ttl time.Duration) (bool, time.Time, error) {
+	select {
+	case <-s.hanging:
+		<-ctx.Done()
+		return false, time.Time{}, ctx.Err()
+	default:
+		return s.LocalRWLockStorage.TryWriteLock(ctx, lockName, ownerName, ttl)
+	}
+}
+
+// checkHolderEndsWithLease waits for the first holder context, makes the storage hang and checks
+// that the holder ends by its ttl instead of waiting for the hanging renewal.
+func checkHolderEndsWithLease(t *testing.T, name string, ttl time.Duration, hanging chan struct{}, holderContext func(ctx context.Context) chan context.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	lockCtxs := holderContext(ctx)
+	lockCtx := <-lockCtxs
+	acquired := time.Now()
+	close(hanging)
+
+	<-lockCtx.Done()
+	if held := time.Since(acquired); held > ttl+time.Millisecond*150 {
+		t.Errorf("%s: holder outlived its ttl %v by %v", name, ttl, held-ttl)
+	}
+	cancel()
+	for range lockCtxs {
+	}
+}
+
+func TestLocalHoldersRenewalBoundedByLease(t *testing.T) {
+	ttl := time.Millisecond * 200
+
+	semaphoreStorage := &hangingSemaphoreStorage{NewLocalSemaphoreStorage(), make(chan struct{})}
+	semaphore := NewSemaphore(semaphoreStorage, "sem1", "owner1", 1, ttl)
+	checkHolderEndsWithLease(t, "semaphore", ttl, semaphoreStorage.hanging, semaphore.SemaphoreContext)
+
+	readStorage := &hangingRWLockStorage{NewLocalRWLockStorage(), make(chan struct{})}
+	reader := NewRWLocker(readStorage, "lock1", "reader1", ttl)
+	checkHolderEndsWithLease(t, "read lock", ttl, readStorage.hanging, reader.ReadLockerContext)
+
+	writeStorage := &hangingRWLockStorage{NewLocalRWLockStorage(), make(chan struct{})}
+	writer := NewRWLocker(writeStorage, "lock1", "writer1", ttl)
+	checkHolderEndsWithLease(t, "write lock", ttl, writeStorage.hanging, writer.WriteLockerContext)
+}
@@ -0,0 +1,195 @@
+package ydb_locker
+
+import (
+	"fmt"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/types"
+	"time"
+)
+
+const (
+	RWLockModeRead  = "read"
+	RWLockModeWrite = "write"
+)
+
+type RWLockRequestBuilder interface {
+	GetLockNameColumnName() string
+	GetOwnerColumnName() string
+	GetModeColumnName() string
+	GetDeadlineColumnName() string
+	GetCreatedColumnName() string
+
+	GetReadLockQueryWithParams(lockName string, owner string, ttl time.Duration) (string, *table.QueryParameters)
+	GetWriteLockQueryWithParams(lockName string, owner string, ttl time.Duration) (string, *table.QueryParameters)
+	GetReleaseRWLockQueryWithParams(lockName string, owner string) (string, *table.QueryParameters)
+}
+
+type RWLockSchemaRequestBuilder interface {
+	GetCreateRWLocksTableQuery() string
+}
+
+// RWLockRequestBuilderImpl keeps one row per holder: (lock_name, owner) -> (mode, deadline, created).
+// A write row is both the exclusive holder and a pending writer: while it is alive no new reader gets in.
+type RWLockRequestBuilderImpl struct {
+	TableName          string
+	LockNameColumnName string
+	OwnerColumnName    string
+	ModeColumnName     string
+	DeadlineColumnName string
+	CreatedColumnName  string
+}
+
+func (l *RWLockRequestBuilderImpl) GetLockNameColumnName() string {
+	return l.LockNameColumnName
+}
+
+func (l *RWLockRequestBuilderImpl) GetOwnerColumnName() string {
+	return l.OwnerColumnName
+}
+
+func (l *RWLockRequestBuilderImpl) GetModeColumnName() string {
+	return l.ModeColumnName
+}
+
+func (l *RWLockRequestBuilderImpl) GetDeadlineColumnName() string {
+	return l.DeadlineColumnName
+}
+
+func (l *RWLockRequestBuilderImpl) GetCreatedColumnName() string {
+	return l.CreatedColumnName
+}
+
+func (l *RWLockRequestBuilderImpl) GetReadLockQueryWithParams(lockName string, owner string, ttl time.Duration) (string, *table.QueryParameters) {
+	// delete expired holders of $lock_name
+	// if $owner already holds a read lock or there are no alive writers:
+	//		upsert ($lock_name, $owner, 'read', CurrentUtcTimestamp() + TTL)
+	return fmt.Sprintf(
+			`DECLARE $LOCK_NAME AS Utf8;
+			DECLARE $OWNER AS Utf8;
+			DECLARE $TTL AS Interval;
+
+			$ts = CurrentUtcTimestamp();
+			$new_ts = $ts + $TTL;
+
+			$held = (
+				select count(*)
+				from %[1]s
+				where %[2]s == $LOCK_NAME and %[3]s == $OWNER and %[4]s == '%[7]s'u and %[5]s > $ts
+			);
+			$writers = (
+				select count(*)
+				from %[1]s
+				where %[2]s == $LOCK_NAME and %[3]s != $OWNER and %[4]s == '%[8]s'u and %[5]s > $ts
+			);
+			$acquired = $held > 0ul or $writers == 0ul;
+
+			delete from %[1]s
+			where %[2]s == $LOCK_NAME and %[5]s <= $ts;
+
+			upsert into %[1]s
+			select * from AS_TABLE(AsList(AsStruct(
+				$LOCK_NAME as %[2]s, $OWNER as %[3]s, '%[7]s'u as %[4]s, $new_ts as %[5]s, $ts as %[6]s
+			)))
+			where $acquired;
+
+			select $acquired as acquired, $new_ts as %[5]s;
+		`, l.TableName, l.LockNameColumnName, l.OwnerColumnName, l.ModeColumnName, l.DeadlineColumnName, l.CreatedColumnName,
+			RWLockModeRead, RWLockModeWrite),
+		table.NewQueryParameters(
+			table.ValueParam("$LOCK_NAME", types.UTF8Value(lockName)),
+			table.ValueParam("$OWNER", types.UTF8Value(owner)),
+			table.ValueParam("$TTL", types.IntervalValueFromMicroseconds(ttl.Microseconds())),
+		)
+}
+
+func (l *RWLockRequestBuilderImpl) GetWriteLockQueryWithParams(lockName string, owner string, ttl time.Duration) (string, *table.QueryParameters) {
+	// delete expired holders of $lock_name
+	// upsert ($lock_name, $owner, 'write', CurrentUtcTimestamp() + TTL), keeping the original created
+	// acquired = no alive readers and no alive writer that registered before $owner
+	return fmt.Sprintf(
+			`DECLARE $LOCK_NAME AS Utf8;
+			DECLARE $OWNER AS Utf8;
+			DECLARE $TTL AS Interval;
+
+			$ts = CurrentUtcTimestamp();
+			$new_ts = $ts + $TTL;
+
+			$mine = (
+				select %[6]s
+				from %[1]s
+				where %[2]s == $LOCK_NAME and %[3]s == $OWNER and %[4]s == '%[8]s'u and %[5]s > $ts
+			);
+			$created = $mine ?? $ts;
+
+			$readers = (
+				select count(*)
+				from %[1]s
+				where %[2]s == $LOCK_NAME and %[3]s != $OWNER and %[4]s == '%[7]s'u and %[5]s > $ts
+			);
+			$earlier_writers = (
+				select count(*)
+				from %[1]s
+				where %[2]s == $LOCK_NAME and %[3]s != $OWNER and %[4]s == '%[8]s'u and %[5]s > $ts
+					and (%[6]s < $created or (%[6]s == $created and %[3]s < $OWNER))
+			);
+			$acquired = $readers == 0ul and $earlier_writers == 0ul;
+
+			delete from %[1]s
+			where %[2]s == $LOCK_NAME and %[5]s <= $ts;
+
+			upsert into %[1]s
+			select * from AS_TABLE(AsList(AsStruct(
+				$LOCK_NAME as %[2]s, $OWNER as %[3]s, '%[8]s'u as %[4]s, $new_ts as %[5]s, $created as %[6]s
+			)));
+
+			select $acquired as acquired, $new_ts as %[5]s;
+		`, l.TableName, l.LockNameColumnName, l.OwnerColumnName, l.ModeColumnName, l.DeadlineColumnName, l.CreatedColumnName,
+			RWLockModeRead, RWLockModeWrite),
+		table.NewQueryParameters(
+			table.ValueParam("$LOCK_NAME", types.UTF8Value(lockName)),
+			table.ValueParam("$OWNER", types.UTF8Value(owner)),
+			table.ValueParam("$TTL", types.IntervalValueFromMicroseconds(ttl.Microseconds())),
+		)
+}
+
+func (l *RWLockRequestBuilderImpl) GetReleaseRWLockQueryWithParams(lockName string, owner string) (string, *table.QueryParameters) {
+	return fmt.Sprintf(
+			`DECLARE $LOCK_NAME AS Utf8;
+			DECLARE $OWNER AS Utf8;
+
+			select count(*) > 0ul as released
+			from %[1]s
+			where %[2]s == $LOCK_NAME and %[3]s == $OWNER and %[4]s > CurrentUtcTimestamp();
+
+			delete from %[1]s
+			where %[2]s == $LOCK_NAME and %[3]s == $OWNER;
+		`, l.TableName, l.LockNameColumnName, l.OwnerColumnName, l.DeadlineColumnName),
+		table.NewQueryParameters(
+			table.ValueParam("$LOCK_NAME", types.UTF8Value(lockName)),
+			table.ValueParam("$OWNER", types.UTF8Value(owner)),
+		)
+}
+
+func (l *RWLockRequestBuilderImpl) GetCreateRWLocksTableQuery() string {
+	return fmt.Sprintf(`
+		create table if not exists %[1]s (
+			%[2]s utf8,
+			%[3]s utf8,
+			%[4]s utf8,
+			%[5]s timestamp,
+			%[6]s timestamp,
+			primary key (%[2]s, %[3]s)
+		);
+	`, "`"+l.TableName+"`", l.LockNameColumnName, l.OwnerColumnName, l.ModeColumnName, l.DeadlineColumnName, l.CreatedColumnName)
+}
+
+func GetDefaultRWLockRequestBuilder(tableName string) *RWLockRequestBuilderImpl {
+	return &RWLockRequestBuilderImpl{
+		TableName:          tableName,
+		LockNameColumnName: "lock_name",
+		OwnerColumnName:    "owner",
+		ModeColumnName:     "mode",
+		DeadlineColumnName: "deadline",
+		CreatedColumnName:  "created",
+	}
+}
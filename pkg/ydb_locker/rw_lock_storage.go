@@ -0,0 +1,151 @@
+package ydb_locker
+
+import (
+	"context"
+	"github.com/jonboulle/clockwork"
+	"github.com/ydb-platform/ydb-go-sdk/v3"
+	"github.com/ydb-platform/ydb-go-sdk/v3/scripting"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table"
+	"sync"
+	"time"
+)
+
+type RWLockStorage interface {
+	TryReadLock(ctx context.Context, lockName string, ownerName string, ttl time.Duration) (bool, time.Time, error)
+	TryWriteLock(ctx context.Context, lockName string, ownerName string, ttl time.Duration) (bool, time.Time, error)
+	ReleaseRWLock(ctx context.Context, lockName string, ownerName string) (bool, error)
+}
+
+type YdbRWLockStorage struct {
+	Db         *ydb.Driver
+	ReqBuilder RWLockRequestBuilder
+}
+
+func (s *YdbRWLockStorage) TryReadLock(ctx context.Context, lockName string, ownerName string, ttl time.Duration) (bool, time.Time, error) {
+	return TryReadLock(ctx, s.Db.Table(), lockName, ownerName, ttl, s.ReqBuilder)
+}
+
+func (s *YdbRWLockStorage) TryWriteLock(ctx context.Context, lockName string, ownerName string, ttl time.Duration) (bool, time.Time, error) {
+	return TryWriteLock(ctx, s.Db.Table(), lockName, ownerName, ttl, s.ReqBuilder)
+}
+
+func (s *YdbRWLockStorage) ReleaseRWLock(ctx context.Context, lockName string, ownerName string) (bool, error) {
+	return ReleaseRWLock(ctx, s.Db.Table(), lockName, ownerName, s.ReqBuilder)
+}
+
+func TryReadLock(ctx context.Context, c table.Client, lockName string, ownerName string, ttl time.Duration, reqBuilder RWLockRequestBuilder) (bool, time.Time, error) {
+	query, params := reqBuilder.GetReadLockQueryWithParams(lockName, ownerName, ttl)
+	return acquireHolder(ctx, c, query, params, reqBuilder.GetDeadlineColumnName())
+}
+
+func TryWriteLock(ctx context.Context, c table.Client, lockName string, ownerName string, ttl time.Duration, reqBuilder RWLockRequestBuilder) (bool, time.Time, error) {
+	query, params := reqBuilder.GetWriteLockQueryWithParams(lockName, ownerName, ttl)
+	return acquireHolder(ctx, c, query, params, reqBuilder.GetDeadlineColumnName())
+}
+
+func ReleaseRWLock(ctx context.Context, c table.Client, lockName string, ownerName string, reqBuilder RWLockRequestBuilder) (bool, error) {
+	query, params := reqBuilder.GetReleaseRWLockQueryWithParams(lockName, ownerName)
+	return execFlagQuery(ctx, c, query, params, "released")
+}
+
+func CreateRWLocksTable(ctx context.Context, c scripting.Client, reqBuilder RWLockSchemaRequestBuilder) error {
+	q := reqBuilder.GetCreateRWLocksTableQuery()
+	_, err := c.Execute(ctx, q, nil)
+	return err
+}
+
+type LocalRWHolder struct {
+	Mode     string
+	Deadline time.Time
+	Created  time.Time
+}
+
+type LocalRWLockStorage struct {
+	// lock name -> owner name -> holder
+	Locks map[string]map[string]*LocalRWHolder
+	Mu    sync.Mutex
+	localClock
+}
+
+func NewLocalRWLockStorage() *LocalRWLockStorage {
+	return &LocalRWLockStorage{
+		Locks:      make(map[string]map[string]*LocalRWHolder),
+		localClock: localClock{Clock: clockwork.NewRealClock()},
+	}
+}
+
+// holders returns the alive holders of the lock, expired ones are deleted as nothing else would.
+func (s *LocalRWLockStorage) holders(lockName string, now time.Time) map[string]*LocalRWHolder {
+	holders, ok := s.Locks[lockName]
+	if !ok {
+		holders = make(map[string]*LocalRWHolder)
+		s.Locks[lockName] = holders
+	}
+	for owner, holder := range holders {
+		if !holder.Deadline.After(now) {
+			delete(holders, owner)
+		}
+	}
+	return holders
+}
+
+func (s *LocalRWLockStorage) TryReadLock(ctx context.Context, lockName string, ownerName string, ttl time.Duration) (bool, time.Time, error) {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	now := s.now()
+	holders := s.holders(lockName, now)
+
+	held := false
+	writers := 0
+	for owner, holder := range holders {
+		if owner == ownerName && holder.Mode == RWLockModeRead {
+			held = true
+		} else if owner != ownerName && holder.Mode == RWLockModeWrite {
+			writers++
+		}
+	}
+
+	newDeadline := now.Add(ttl)
+	if !held && writers > 0 {
+		return false, newDeadline, nil
+	}
+	holders[ownerName] = &LocalRWHolder{Mode: RWLockModeRead, Deadline: newDeadline, Created: now}
+	return true, newDeadline, nil
+}
+
+func (s *LocalRWLockStorage) TryWriteLock(ctx context.Context, lockName string, ownerName string, ttl time.Duration) (bool, time.Time, error) {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	now := s.now()
+	holders := s.holders(lockName, now)
+
+	created := now
+	if mine, ok := holders[ownerName]; ok && mine.Mode == RWLockModeWrite {
+		created = mine.Created
+	}
+
+	blockers := 0
+	for owner, holder := range holders {
+		if owner == ownerName {
+			continue
+		}
+		if holder.Mode == RWLockModeRead {
+			blockers++
+		} else if holder.Created.Before(created) || (holder.Created.Equal(created) && owner < ownerName) {
+			blockers++
+		}
+	}
+
+	newDeadline := now.Add(ttl)
+	holders[ownerName] = &LocalRWHolder{Mode: RWLockModeWrite, Deadline: newDeadline, Created: created}
+	return blockers == 0, newDeadline, nil
+}
+
+func (s *LocalRWLockStorage) ReleaseRWLock(ctx context.Context, lockName string, ownerName string) (bool, error) {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	holders := s.Locks[lockName]
+	holder, ok := holders[ownerName]
+	delete(holders, ownerName)
+	return ok && holder.Deadline.After(s.now()), nil
+}
@@ -0,0 +1,82 @@
+package ydb_locker
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// RWLocker hands out shared (read) and exclusive (write) lease contexts for LockName.
+// Writers are preferred: once a writer is waiting no new reader is let in, readers that
+// already hold the lock keep renewing until they are done.
+// OwnerName identifies a single holder, use different owners for concurrent read and write contexts.
+type RWLocker struct {
+	LockStorage RWLockStorage
+	LockName    string
+	OwnerName   string
+	Ttl         time.Duration
+
+	// OnError receives storage errors, they never stop the locker.
+	OnError func(error)
+	// Logger receives structured holder lifecycle events, NewRWLocker sets a no-op one.
+	Logger *slog.Logger
+	// Metrics is notified about acquisitions, losses and renewals of the holder.
+	Metrics Metrics
+
+	options *lockerOptions
+}
+
+// NewRWLocker creates a read-write locker. The renewal, release timeout, clock, event buffer, error, logger and metrics
+// options of Locker apply to it as well, the options of ExecuteUnderLock workers and events have no effect.
+func NewRWLocker(lockStorage RWLockStorage, lockName string, ownerName string, ttl time.Duration, opts ...LockerOption) *RWLocker {
+	options := newLockerOptions(opts...).clamp(ttl)
+	return &RWLocker{
+		LockStorage: lockStorage,
+		LockName:    lockName,
+		OwnerName:   ownerName,
+		Ttl:         ttl,
+		OnError:     options.onError,
+		Logger:      loggerOrNop(options.logger),
+		Metrics:     metricsOrNop(options.metrics),
+		options:     options,
+	}
+}
+
+// opts returns the options the locker was created with, defaults for a RWLocker built without NewRWLocker.
+func (l *RWLocker) opts() *lockerOptions {
+	if l.options == nil {
+		return defaultLockerOptions()
+	}
+	return l.options
+}
+
+func (l *RWLocker) release(ctx context.Context) error {
+	_, err := l.LockStorage.ReleaseRWLock(ctx, l.LockName, l.OwnerName)
+	return err
+}
+
+// holderContext runs the holder loop with the hooks taken from the fields, they may be changed after NewRWLocker.
+func (l *RWLocker) holderContext(ctx context.Context, tryAcquire func(ctx context.Context) (bool, time.Time, error)) chan context.Context {
+	run := *l.opts()
+	run.onError, run.logger, run.metrics = l.OnError, l.Logger, l.Metrics
+	lockCtxs := make(chan context.Context, run.eventBufferSize)
+
+	go func() {
+		defer close(lockCtxs)
+		holderContext(ctx, l.LockName, l.OwnerName, tryAcquire, l.release, l.Ttl, lockCtxs, &run)
+	}()
+
+	return lockCtxs
+}
+
+func (l *RWLocker) ReadLockerContext(ctx context.Context) chan context.Context {
+	return l.holderContext(ctx, func(ctx context.Context) (bool, time.Time, error) {
+		return l.LockStorage.TryReadLock(ctx, l.LockName, l.OwnerName, l.Ttl)
+	})
+}
+
+func (l *RWLocker) WriteLockerContext(ctx context.Context) chan context.Context {
+	return l.holderContext(ctx, func(ctx context.Context) (bool, time.Time, error) {
+		return l.LockStorage.TryWriteLock(ctx, l.LockName, l.OwnerName, l.Ttl)
+	})
+}
@@ -0,0 +1,119 @@
+package ydb_locker
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLocalRWLockWriterPreference(t *testing.T) {
+	ctx := context.Background()
+	storage := NewLocalRWLockStorage()
+	ttl := time.Second * 10
+
+	for _, reader := range []string{"reader1", "reader2"} {
+		if ok, _, _ := storage.TryReadLock(ctx, "lock1", reader, ttl); !ok {
+			t.Fatalf("%s expected to acquire a read lock", reader)
+		}
+	}
+	if ok, _, _ := storage.TryWriteLock(ctx, "lock1", "writer1", ttl); ok {
+		t.Fatal("writer acquired the lock while readers hold it")
+	}
+	if ok, _, _ := storage.TryReadLock(ctx, "lock1", "reader3", ttl); ok {
+		t.Error("new reader acquired the lock while a writer is waiting")
+	}
+	if ok, _, _ := storage.TryReadLock(ctx, "lock1", "reader1", ttl); !ok {
+		t.Error("holding reader failed to renew")
+	}
+	if ok, _, _ := storage.TryWriteLock(ctx, "lock1", "writer2", ttl); ok {
+		t.Error("second writer overtook the first one")
+	}
+
+	storage.ReleaseRWLock(ctx, "lock1", "reader1")
+	storage.ReleaseRWLock(ctx, "lock1", "reader2")
+
+	if ok, _, _ := storage.TryWriteLock(ctx, "lock1", "writer2", ttl); ok {
+		t.Error("second writer overtook the first one")
+	}
+	if ok, _, _ := storage.TryWriteLock(ctx, "lock1", "writer1", ttl); !ok {
+		t.Error("writer failed to acquire the lock after readers left")
+	}
+}
+
+func TestLocalRWLockDropsExpiredHolders(t *testing.T) {
+	ctx := context.Background()
+	storage := NewLocalRWLockStorage()
+
+	if ok, _, _ := storage.TryReadLock(ctx, "lock1", "reader1", time.Millisecond); !ok {
+		t.Fatal("reader1 expected to acquire a read lock")
+	}
+	if ok, _, _ := storage.TryWriteLock(ctx, "lock1", "writer1", time.Millisecond); ok {
+		t.Fatal("writer acquired the lock while a reader holds it")
+	}
+	time.Sleep(time.Millisecond * 10)
+	if ok, _, _ := storage.TryReadLock(ctx, "lock1", "reader2", time.Second); !ok {
+		t.Fatal("reader2 expected to acquire a read lock after the writer expired")
+	}
+
+	storage.Mu.Lock()
+	defer storage.Mu.Unlock()
+	for _, owner := range []string{"reader1", "writer1"} {
+		if _, ok := storage.Locks["lock1"][owner]; ok {
+			t.Errorf("expected the expired holder %s to be deleted", owner)
+		}
+	}
+}
+
+func TestLocalRWLockerCtxExclusive(t *testing.T) {
+	ctx := context.Background()
+	storage := NewLocalRWLockStorage()
+
+	ctx1s, cancel := context.WithTimeout(ctx, time.Second*1)
+	defer cancel()
+
+	var readers atomic.Int64
+	var writers atomic.Int64
+	var writes atomic.Int64
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			locker := NewRWLocker(storage, "lock1", uuid.New().String(), time.Millisecond*100)
+
+			if i == 0 {
+				for lockCtx := range locker.WriteLockerContext(ctx1s) {
+					writers.Add(1)
+					writes.Add(1)
+					if readers.Load() != 0 {
+						t.Error("writer runs together with readers")
+					}
+					time.Sleep(time.Millisecond * 50)
+					writers.Add(-1)
+					<-lockCtx.Done()
+				}
+				return
+			}
+
+			c, cancel := context.WithTimeout(ctx1s, time.Millisecond*300)
+			defer cancel()
+			for lockCtx := range locker.ReadLockerContext(c) {
+				readers.Add(1)
+				if writers.Load() != 0 {
+					t.Error("reader runs together with a writer")
+				}
+				<-lockCtx.Done()
+				readers.Add(-1)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if writes.Load() == 0 {
+		t.Error("writer never acquired the lock")
+	}
+}
@@ -0,0 +1,76 @@
+package ydb_locker
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Semaphore lets at most Limit owners hold SemaphoreName at the same time.
+// Every holder keeps its own slot alive with the same TTL model as Locker.
+type Semaphore struct {
+	SemaphoreStorage SemaphoreStorage
+	SemaphoreName    string
+	OwnerName        string
+	Limit            uint64
+	Ttl              time.Duration
+
+	// OnError receives storage errors, they never stop the semaphore.
+	OnError func(error)
+	// Logger receives structured slot lifecycle events, NewSemaphore sets a no-op one.
+	Logger *slog.Logger
+	// Metrics is notified about acquisitions, losses and renewals of the slot.
+	Metrics Metrics
+
+	options *lockerOptions
+}
+
+// NewSemaphore creates a semaphore. The renewal, release timeout, clock, event buffer, error, logger and metrics
+// options of Locker apply to it as well, the options of ExecuteUnderLock workers and events have no effect.
+func NewSemaphore(semaphoreStorage SemaphoreStorage, semaphoreName string, ownerName string, limit uint64, ttl time.Duration, opts ...LockerOption) *Semaphore {
+	options := newLockerOptions(opts...).clamp(ttl)
+	return &Semaphore{
+		SemaphoreStorage: semaphoreStorage,
+		SemaphoreName:    semaphoreName,
+		OwnerName:        ownerName,
+		Limit:            limit,
+		Ttl:              ttl,
+		OnError:          options.onError,
+		Logger:           loggerOrNop(options.logger),
+		Metrics:          metricsOrNop(options.metrics),
+		options:          options,
+	}
+}
+
+// opts returns the options the semaphore was created with, defaults for a Semaphore built without NewSemaphore.
+func (s *Semaphore) opts() *lockerOptions {
+	if s.options == nil {
+		return defaultLockerOptions()
+	}
+	return s.options
+}
+
+func (s *Semaphore) tryAcquire(ctx context.Context) (bool, time.Time, error) {
+	return s.SemaphoreStorage.TryAcquireSemaphore(ctx, s.SemaphoreName, s.OwnerName, s.Limit, s.Ttl)
+}
+
+func (s *Semaphore) release(ctx context.Context) error {
+	_, err := s.SemaphoreStorage.ReleaseSemaphore(ctx, s.SemaphoreName, s.OwnerName)
+	return err
+}
+
+// SemaphoreContext yields a context every time a slot is acquired; the context is cancelled
+// when the slot is lost. The slot is released once ctx is done.
+func (s *Semaphore) SemaphoreContext(ctx context.Context) chan context.Context {
+	// The hooks come from the fields, they may be changed after NewSemaphore.
+	run := *s.opts()
+	run.onError, run.logger, run.metrics = s.OnError, s.Logger, s.Metrics
+	lockCtxs := make(chan context.Context, run.eventBufferSize)
+
+	go func() {
+		defer close(lockCtxs)
+		holderContext(ctx, s.SemaphoreName, s.OwnerName, s.tryAcquire, s.release, s.Ttl, lockCtxs, &run)
+	}()
+
+	return lockCtxs
+}
@@ -0,0 +1,127 @@
+package ydb_locker
+
+import (
+	"fmt"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/types"
+	"time"
+)
+
+type SemaphoreRequestBuilder interface {
+	GetSemaphoreNameColumnName() string
+	GetOwnerColumnName() string
+	GetDeadlineColumnName() string
+
+	GetAcquireSemaphoreQueryWithParams(semaphoreName string, owner string, limit uint64, ttl time.Duration) (string, *table.QueryParameters)
+	GetReleaseSemaphoreQueryWithParams(semaphoreName string, owner string) (string, *table.QueryParameters)
+	GetSelectSemaphoreHoldersQueryWithParams(semaphoreName string) (string, *table.QueryParameters)
+}
+
+type SemaphoreSchemaRequestBuilder interface {
+	GetCreateSemaphoresTableQuery() string
+}
+
+// SemaphoreRequestBuilderImpl keeps one row per holder: (semaphore_name, owner) -> deadline.
+type SemaphoreRequestBuilderImpl struct {
+	TableName               string
+	SemaphoreNameColumnName string
+	OwnerColumnName         string
+	DeadlineColumnName      string
+}
+
+func (l *SemaphoreRequestBuilderImpl) GetSemaphoreNameColumnName() string {
+	return l.SemaphoreNameColumnName
+}
+
+func (l *SemaphoreRequestBuilderImpl) GetOwnerColumnName() string {
+	return l.OwnerColumnName
+}
+
+func (l *SemaphoreRequestBuilderImpl) GetDeadlineColumnName() string {
+	return l.DeadlineColumnName
+}
+
+func (l *SemaphoreRequestBuilderImpl) GetAcquireSemaphoreQueryWithParams(semaphoreName string, owner string, limit uint64, ttl time.Duration) (string, *table.QueryParameters) {
+	// delete expired holders of $semaphore_name
+	// if count(alive holders except $owner) < $limit:
+	//		upsert ($semaphore_name, $owner, CurrentUtcTimestamp() + TTL)
+	return fmt.Sprintf(
+			`DECLARE $SEMAPHORE_NAME AS Utf8;
+			DECLARE $OWNER AS Utf8;
+			DECLARE $LIMIT AS Uint64;
+			DECLARE $TTL AS Interval;
+
+			$ts = CurrentUtcTimestamp();
+			$new_ts = $ts + $TTL;
+
+			$holders = (
+				select count(*)
+				from %[1]s
+				where %[2]s == $SEMAPHORE_NAME and %[3]s != $OWNER and %[4]s > $ts
+			);
+			$acquired = $holders < $LIMIT;
+
+			delete from %[1]s
+			where %[2]s == $SEMAPHORE_NAME and %[4]s <= $ts;
+
+			upsert into %[1]s
+			select * from AS_TABLE(AsList(AsStruct($SEMAPHORE_NAME as %[2]s, $OWNER as %[3]s, $new_ts as %[4]s)))
+			where $acquired;
+
+			select $acquired as acquired, $new_ts as %[4]s;
+		`, l.TableName, l.SemaphoreNameColumnName, l.OwnerColumnName, l.DeadlineColumnName),
+		table.NewQueryParameters(
+			table.ValueParam("$SEMAPHORE_NAME", types.UTF8Value(semaphoreName)),
+			table.ValueParam("$OWNER", types.UTF8Value(owner)),
+			table.ValueParam("$LIMIT", types.Uint64Value(limit)),
+			table.ValueParam("$TTL", types.IntervalValueFromMicroseconds(ttl.Microseconds())),
+		)
+}
+
+func (l *SemaphoreRequestBuilderImpl) GetReleaseSemaphoreQueryWithParams(semaphoreName string, owner string) (string, *table.QueryParameters) {
+	return fmt.Sprintf(
+			`DECLARE $SEMAPHORE_NAME AS Utf8;
+			DECLARE $OWNER AS Utf8;
+
+			select count(*) > 0ul as released
+			from %[1]s
+			where %[2]s == $SEMAPHORE_NAME and %[3]s == $OWNER and %[4]s > CurrentUtcTimestamp();
+
+			delete from %[1]s
+			where %[2]s == $SEMAPHORE_NAME and %[3]s == $OWNER;
+		`, l.TableName, l.SemaphoreNameColumnName, l.OwnerColumnName, l.DeadlineColumnName),
+		table.NewQueryParameters(
+			table.ValueParam("$SEMAPHORE_NAME", types.UTF8Value(semaphoreName)),
+			table.ValueParam("$OWNER", types.UTF8Value(owner)),
+		)
+}
+
+func (l *SemaphoreRequestBuilderImpl) GetSelectSemaphoreHoldersQueryWithParams(semaphoreName string) (string, *table.QueryParameters) {
+	return fmt.Sprintf(
+			`DECLARE $SEMAPHORE_NAME AS Utf8;
+			SELECT %[3]s FROM %[1]s
+			WHERE %[2]s = $SEMAPHORE_NAME AND %[4]s > CurrentUtcTimestamp()
+			ORDER BY %[3]s`,
+			l.TableName, l.SemaphoreNameColumnName, l.OwnerColumnName, l.DeadlineColumnName),
+		table.NewQueryParameters(table.ValueParam("$SEMAPHORE_NAME", types.UTF8Value(semaphoreName)))
+}
+
+func (l *SemaphoreRequestBuilderImpl) GetCreateSemaphoresTableQuery() string {
+	return fmt.Sprintf(`
+		create table if not exists %[1]s (
+			%[2]s utf8,
+			%[3]s utf8,
+			%[4]s timestamp,
+			primary key (%[2]s, %[3]s)
+		);
+	`, "`"+l.TableName+"`", l.SemaphoreNameColumnName, l.OwnerColumnName, l.DeadlineColumnName)
+}
+
+func GetDefaultSemaphoreRequestBuilder(tableName string) *SemaphoreRequestBuilderImpl {
+	return &SemaphoreRequestBuilderImpl{
+		TableName:               tableName,
+		SemaphoreNameColumnName: "semaphore_name",
+		OwnerColumnName:         "owner",
+		DeadlineColumnName:      "deadline",
+	}
+}
@@ -0,0 +1,148 @@
+package ydb_locker
+
+import (
+	"context"
+	"fmt"
+	"github.com/jonboulle/clockwork"
+	"github.com/ydb-platform/ydb-go-sdk/v3"
+	"github.com/ydb-platform/ydb-go-sdk/v3/scripting"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/result/named"
+	"sort"
+	"sync"
+	"time"
+)
+
+type SemaphoreStorage interface {
+	TryAcquireSemaphore(ctx context.Context, semaphoreName string, ownerName string, limit uint64, ttl time.Duration) (bool, time.Time, error)
+	ReleaseSemaphore(ctx context.Context, semaphoreName string, ownerName string) (bool, error)
+	GetSemaphoreHolders(ctx context.Context, semaphoreName string) ([]string, error)
+}
+
+type YdbSemaphoreStorage struct {
+	Db         *ydb.Driver
+	ReqBuilder SemaphoreRequestBuilder
+}
+
+func (s *YdbSemaphoreStorage) TryAcquireSemaphore(ctx context.Context, semaphoreName string, ownerName string, limit uint64, ttl time.Duration) (bool, time.Time, error) {
+	return TryAcquireSemaphore(ctx, s.Db.Table(), semaphoreName, ownerName, limit, ttl, s.ReqBuilder)
+}
+
+func (s *YdbSemaphoreStorage) ReleaseSemaphore(ctx context.Context, semaphoreName string, ownerName string) (bool, error) {
+	return ReleaseSemaphore(ctx, s.Db.Table(), semaphoreName, ownerName, s.ReqBuilder)
+}
+
+func (s *YdbSemaphoreStorage) GetSemaphoreHolders(ctx context.Context, semaphoreName string) ([]string, error) {
+	return GetSemaphoreHolders(ctx, s.Db.Table(), semaphoreName, s.ReqBuilder)
+}
+
+func TryAcquireSemaphore(ctx context.Context, c table.Client, semaphoreName string, ownerName string, limit uint64, ttl time.Duration, reqBuilder SemaphoreRequestBuilder) (bool, time.Time, error) {
+	query, params := reqBuilder.GetAcquireSemaphoreQueryWithParams(semaphoreName, ownerName, limit, ttl)
+	return acquireHolder(ctx, c, query, params, reqBuilder.GetDeadlineColumnName())
+}
+
+func ReleaseSemaphore(ctx context.Context, c table.Client, semaphoreName string, ownerName string, reqBuilder SemaphoreRequestBuilder) (bool, error) {
+	query, params := reqBuilder.GetReleaseSemaphoreQueryWithParams(semaphoreName, ownerName)
+	return execFlagQuery(ctx, c, query, params, "released")
+}
+
+func GetSemaphoreHolders(ctx context.Context, c table.Client, semaphoreName string, reqBuilder SemaphoreRequestBuilder) ([]string, error) {
+	var holders []string
+
+	query, params := reqBuilder.GetSelectSemaphoreHoldersQueryWithParams(semaphoreName)
+	readTx := table.TxControl(table.BeginTx(table.WithOnlineReadOnly()), table.CommitTx())
+	err := c.Do(ctx, func(ctx context.Context, s table.Session) error {
+		holders = holders[:0]
+		_, res, err := s.Execute(ctx, readTx, query, params)
+		if err != nil {
+			return fmt.Errorf("execute error: %w", err)
+		}
+		defer res.Close()
+		if err = res.NextResultSetErr(ctx); err != nil {
+			return fmt.Errorf("next result set error: %w", err)
+		}
+		for res.NextRow() {
+			var owner string
+			if err = res.ScanNamed(named.OptionalWithDefault(reqBuilder.GetOwnerColumnName(), &owner)); err != nil {
+				return fmt.Errorf("scan error: %w", err)
+			}
+			holders = append(holders, owner)
+		}
+		return res.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return holders, nil
+}
+
+func CreateSemaphoresTable(ctx context.Context, c scripting.Client, reqBuilder SemaphoreSchemaRequestBuilder) error {
+	q := reqBuilder.GetCreateSemaphoresTableQuery()
+	_, err := c.Execute(ctx, q, nil)
+	return err
+}
+
+type LocalSemaphoreStorage struct {
+	// semaphore name -> owner name -> deadline
+	Semaphores map[string]map[string]time.Time
+	Mu         sync.Mutex
+	localClock
+}
+
+func NewLocalSemaphoreStorage() *LocalSemaphoreStorage {
+	return &LocalSemaphoreStorage{
+		Semaphores: make(map[string]map[string]time.Time),
+		localClock: localClock{Clock: clockwork.NewRealClock()},
+	}
+}
+
+func (s *LocalSemaphoreStorage) TryAcquireSemaphore(ctx context.Context, semaphoreName string, ownerName string, limit uint64, ttl time.Duration) (bool, time.Time, error) {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	holders, ok := s.Semaphores[semaphoreName]
+	if !ok {
+		holders = make(map[string]time.Time)
+		s.Semaphores[semaphoreName] = holders
+	}
+
+	now := s.now()
+	var alive uint64
+	for owner, deadline := range holders {
+		if !deadline.After(now) {
+			// Holders that never released their slot are dropped here, nothing else would.
+			delete(holders, owner)
+		} else if owner != ownerName {
+			alive++
+		}
+	}
+
+	newDeadline := now.Add(ttl)
+	if alive >= limit {
+		return false, newDeadline, nil
+	}
+	holders[ownerName] = newDeadline
+	return true, newDeadline, nil
+}
+
+func (s *LocalSemaphoreStorage) ReleaseSemaphore(ctx context.Context, semaphoreName string, ownerName string) (bool, error) {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	holders := s.Semaphores[semaphoreName]
+	deadline, ok := holders[ownerName]
+	delete(holders, ownerName)
+	return ok && deadline.After(s.now()), nil
+}
+
+func (s *LocalSemaphoreStorage) GetSemaphoreHolders(ctx context.Context, semaphoreName string) ([]string, error) {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	now := s.now()
+	var holders []string
+	for owner, deadline := range s.Semaphores[semaphoreName] {
+		if deadline.After(now) {
+			holders = append(holders, owner)
+		}
+	}
+	sort.Strings(holders)
+	return holders, nil
+}
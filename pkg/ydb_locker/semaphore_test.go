@@ -0,0 +1,211 @@
+package ydb_locker
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/jonboulle/clockwork"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLocalSemaphoreCtxLimit(t *testing.T) {
+	ctx := context.Background()
+	storage := NewLocalSemaphoreStorage()
+
+	ctx1s, cancel := context.WithTimeout(ctx, time.Second*1)
+	defer cancel()
+
+	var running atomic.Int64
+	var maxRunning atomic.Int64
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			semaphore := NewSemaphore(storage, "sem1", uuid.New().String(), 2, time.Millisecond*100)
+
+			for lockCtx := range semaphore.SemaphoreContext(ctx1s) {
+				cur := running.Add(1)
+				for {
+					prev := maxRunning.Load()
+					if cur <= prev || maxRunning.CompareAndSwap(prev, cur) {
+						break
+					}
+				}
+				<-lockCtx.Done()
+				running.Add(-1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if maxRunning.Load() != 2 {
+		t.Errorf("expected 2 concurrent holders, got %d", maxRunning.Load())
+	}
+	if holders, _ := storage.GetSemaphoreHolders(ctx, "sem1"); len(holders) != 0 {
+		t.Errorf("expected all slots released, got %v", holders)
+	}
+}
+
+func TestLocalSemaphoreDropsExpiredHolders(t *testing.T) {
+	ctx := context.Background()
+	storage := NewLocalSemaphoreStorage()
+
+	if acquired, _, _ := storage.TryAcquireSemaphore(ctx, "sem1", "owner1", 2, time.Millisecond); !acquired {
+		t.Fatal("expected owner1 to acquire a slot")
+	}
+	time.Sleep(time.Millisecond * 10)
+	if acquired, _, _ := storage.TryAcquireSemaphore(ctx, "sem1", "owner2", 2, time.Second); !acquired {
+		t.Fatal("expected owner2 to acquire a slot")
+	}
+
+	storage.Mu.Lock()
+	defer storage.Mu.Unlock()
+	if _, ok := storage.Semaphores["sem1"]["owner1"]; ok {
+		t.Error("expected the expired holder to be deleted")
+	}
+}
+
+func TestLocalSemaphoreCtxVirtualTime(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	clock := clockwork.NewFakeClock()
+	storage := NewLocalSemaphoreStorage()
+	storage.Clock = clock
+	newSemaphore := func(owner string) *Semaphore {
+		return NewSemaphore(storage, "sem1", owner, 1, time.Second*10, WithClock(clock), WithRenewJitter(0))
+	}
+	waitFor := func(cond func() bool) {
+		for !cond() {
+			select {
+			case <-ctx.Done():
+				t.Fatal("semaphore loop is stuck")
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}
+	renewed := func() bool {
+		storage.Mu.Lock()
+		defer storage.Mu.Unlock()
+		return storage.Semaphores["sem1"]["owner1"].Equal(clock.Now().Add(time.Second * 10))
+	}
+
+	ctx1, stop1 := context.WithCancel(ctx)
+	slots1 := newSemaphore("owner1").SemaphoreContext(ctx1)
+	slot1 := <-slots1
+
+	// Renewals keep the slot for three ttls of virtual time.
+	for i := 0; i < 30; i++ {
+		clock.Advance(time.Second)
+		waitFor(renewed)
+	}
+	if slot1.Err() != nil {
+		t.Fatal("slot was lost while renewed")
+	}
+
+	// Once owner1 stops, owner2 gets the slot at its next poll.
+	slots2 := newSemaphore("owner2").SemaphoreContext(ctx)
+	stop1()
+	for range slots1 {
+	}
+	var slot2 context.Context
+	waitFor(func() bool {
+		select {
+		case slot2 = <-slots2:
+			return true
+		default:
+			clock.Advance(time.Second)
+			return false
+		}
+	})
+	if slot2.Err() != nil {
+		t.Error("owner2 got a cancelled slot")
+	}
+	cancel()
+	for range slots2 {
+	}
+}
+
+func TestYdbSemaphoreAcquireRelease(t *testing.T) {
+	ctx := context.Background()
+	db := ConnectToDb(t, ctx)
+	reqBuilder := GetDefaultSemaphoreRequestBuilder("TestYdbSemaphoreAcquireRelease")
+
+	DropTableIfExists(t, ctx, db.Scripting(), reqBuilder.TableName)
+	if err := CreateSemaphoresTable(ctx, db.Scripting(), reqBuilder); err != nil {
+		t.Fatal("create table error", err)
+	}
+	storage := YdbSemaphoreStorage{db, reqBuilder}
+
+	for _, owner := range []string{"owner1", "owner2"} {
+		acquired, _, err := storage.TryAcquireSemaphore(ctx, "sem1", owner, 2, time.Second*10)
+		if err != nil {
+			t.Fatal("acquire error", err)
+		}
+		if !acquired {
+			t.Errorf("%s expected to acquire a slot", owner)
+		}
+	}
+	acquired, _, err := storage.TryAcquireSemaphore(ctx, "sem1", "owner3", 2, time.Second*10)
+	if err != nil {
+		t.Fatal("acquire error", err)
+	}
+	if acquired {
+		t.Error("owner3 acquired a slot over the limit")
+	}
+
+	released, err := storage.ReleaseSemaphore(ctx, "sem1", "owner1")
+	if err != nil || !released {
+		t.Fatal("release error", released, err)
+	}
+	acquired, _, err = storage.TryAcquireSemaphore(ctx, "sem1", "owner3", 2, time.Second*10)
+	if err != nil || !acquired {
+		t.Fatal("owner3 expected to acquire a released slot", err)
+	}
+
+	holders, err := storage.GetSemaphoreHolders(ctx, "sem1")
+	if err != nil {
+		t.Fatal("get holders error", err)
+	}
+	if len(holders) != 2 || holders[0] != "owner2" || holders[1] != "owner3" {
+		t.Errorf("unexpected holders: %v", holders)
+	}
+}
+
+type holderCountingMetrics struct {
+	NopMetrics
+	acquisitions atomic.Int64
+	losses       atomic.Int64
+}
+
+func (m *holderCountingMetrics) LockAcquired(string) {
+	m.acquisitions.Add(1)
+}
+
+func (m *holderCountingMetrics) LockLost(string) {
+	m.losses.Add(1)
+}
+
+func TestLocalSemaphoreOptions(t *testing.T) {
+	ctx := context.Background()
+	metrics := &holderCountingMetrics{}
+	semaphore := NewSemaphore(NewLocalSemaphoreStorage(), "sem1", "owner1", 1, time.Second*10,
+		WithEventBufferSize(3), WithMetrics(metrics))
+
+	semCtx, cancel := context.WithCancel(ctx)
+	lockCtxs := semaphore.SemaphoreContext(semCtx)
+	if cap(lockCtxs) != 3 {
+		t.Errorf("expected the channel buffer 3, got %d", cap(lockCtxs))
+	}
+	<-lockCtxs
+	cancel()
+	for range lockCtxs {
+	}
+
+	if a, l := metrics.acquisitions.Load(), metrics.losses.Load(); a != 1 || l != 1 {
+		t.Errorf("expected one acquisition and one loss, got %d and %d", a, l)
+	}
+}
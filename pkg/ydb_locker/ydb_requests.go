@@ -2,6 +2,7 @@ package ydb_locker
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/ydb-platform/ydb-go-genproto/protos/Ydb"
 	"github.com/ydb-platform/ydb-go-sdk/v3"
@@ -17,13 +18,13 @@ func GetLockOwner(ctx context.Context, s table.Session, lockName string, reqBuil
 	query, params := reqBuilder.GetSelectLockQueryWithParams(lockName)
 	txr, res, err := s.Execute(ctx, readOwnerTx, query, params)
 	if err != nil {
-		return "", txr, fmt.Errorf("execute error: %w", err)
+		return "", txr, fmt.Errorf("execute error: %w", schemeError(err))
 	}
 	if err = res.NextResultSetErr(ctx); err != nil {
 		return "", txr, fmt.Errorf("next result set error: %w", err)
 	}
 	if !res.NextRow() {
-		return "", txr, fmt.Errorf("no rows in result: %w", err)
+		return "", txr, ErrLockNotFound
 	}
 	var owner string
 	err = res.ScanNamed(named.OptionalWithDefault(reqBuilder.GetOwnerColumnName(), &owner))
@@ -33,83 +34,311 @@ func GetLockOwner(ctx context.Context, s table.Session, lockName string, reqBuil
 	return owner, txr, nil
 }
 
+func GetLock(ctx context.Context, c table.Client, lockName string, reqBuilder LockRequestBuilder, opts ...table.Option) (LockInfo, error) {
+	info := LockInfo{LockName: lockName}
+
+	query, params := reqBuilder.GetSelectLockQueryWithParams(lockName)
+	readTx := table.TxControl(table.BeginTx(table.WithOnlineReadOnly()), table.CommitTx())
+	err := c.Do(ctx, func(ctx context.Context, s table.Session) error {
+		_, res, err := s.Execute(ctx, readTx, query, params)
+		if err != nil {
+			return fmt.Errorf("execute error: %w", err)
+		}
+		defer res.Close()
+		if err = res.NextResultSetErr(ctx); err != nil {
+			return fmt.Errorf("next result set error: %w", err)
+		}
+		if !res.NextRow() {
+			return ErrLockNotFound
+		}
+		values := []named.Value{
+			named.OptionalWithDefault(reqBuilder.GetOwnerColumnName(), &info.Owner),
+			named.OptionalWithDefault(reqBuilder.GetDeadlineColumnName(), &info.Deadline),
+			named.Required("alive", &info.Alive),
+		}
+		values = withOptionalColumn(values, reqBuilder.GetGenerationColumnName(), &info.Generation)
+		values = withOptionalColumn(values, reqBuilder.GetMetadataColumnName(), &info.Metadata)
+		err = res.ScanNamed(values...)
+		if err != nil {
+			return fmt.Errorf("scan error: %w", err)
+		}
+		return nil
+	}, opts...)
+	if err != nil {
+		return LockInfo{}, schemeError(err)
+	}
+	return info, nil
+}
+
+// CheckLockOwner reports whether expectedOwner holds a live lease, the transaction is rolled back if it does not.
 func CheckLockOwner(ctx context.Context, s table.Session, lockName string, expectedOwner string, reqBuilder LockRequestBuilder) (bool, table.Transaction, error) {
-	owner, txr, err := GetLockOwner(ctx, s, lockName, reqBuilder)
+	txr, err := CheckLease(ctx, s, lockName, expectedOwner, 0, reqBuilder)
+	if errors.Is(err, ErrNotOwner) || errors.Is(err, ErrLockExpired) {
+		return false, txr, nil
+	}
 	if err != nil {
 		return false, txr, err
 	}
+	return true, txr, nil
+}
 
-	if owner != expectedOwner {
-		return false, txr, txr.Rollback(ctx)
+// CheckLease begins a serializable transaction that reads the lock and checks that owner holds it with
+// a deadline in the future by the server clock and, unless generation is 0, with that generation.
+// ErrNotOwner or ErrLockExpired is returned otherwise, the transaction is rolled back then.
+func CheckLease(ctx context.Context, s table.Session, lockName string, owner string, generation uint64, reqBuilder LockRequestBuilder) (table.Transaction, error) {
+	return checkLease(ctx, s, TxSerializableReadWrite, lockName, owner, generation, reqBuilder)
+}
+
+// checkLease is CheckLease in the given mode, the returned transaction is nil if the mode is not interactive.
+func checkLease(ctx context.Context, s table.Session, mode TxMode, lockName string, owner string, generation uint64, reqBuilder LockRequestBuilder) (table.Transaction, error) {
+	query, params := reqBuilder.GetCheckLeaseQueryWithParams(lockName)
+	txr, res, err := s.Execute(ctx, mode.txControl(), query, params)
+	if !mode.interactive() {
+		txr = nil
+	}
+	if err != nil {
+		return txr, fmt.Errorf("execute error: %w", schemeError(err))
+	}
+	defer res.Close()
+	if err = res.NextResultSetErr(ctx); err != nil {
+		return txr, fmt.Errorf("next result set error: %w", err)
+	}
+	if !res.NextRow() {
+		return txr, ErrLockNotFound
+	}
+	var curOwner string
+	var curGeneration uint64
+	var alive bool
+	values := []named.Value{
+		named.OptionalWithDefault(reqBuilder.GetOwnerColumnName(), &curOwner),
+		named.Required("alive", &alive),
+	}
+	values = withOptionalColumn(values, reqBuilder.GetGenerationColumnName(), &curGeneration)
+	err = res.ScanNamed(values...)
+	if err != nil {
+		return txr, fmt.Errorf("scan error: %w", err)
 	}
 
-	return true, txr, nil
+	switch {
+	case curOwner != owner:
+		err = fmt.Errorf("%w: held by %s", ErrNotOwner, curOwner)
+	case !alive:
+		err = ErrLockExpired
+	case generation != 0 && reqBuilder.GetGenerationColumnName() != "" && curGeneration != generation:
+		err = fmt.Errorf("%w: generation %d, lease generation %d", ErrLockExpired, curGeneration, generation)
+	default:
+		return txr, nil
+	}
+	if txr == nil {
+		return nil, err
+	}
+	if rollbackErr := txr.Rollback(ctx); rollbackErr != nil {
+		return txr, fmt.Errorf("rollback error: %w", rollbackErr)
+	}
+	return txr, err
 }
 
-func tryLock(ctx context.Context, s table.Session, lockName string, owner string, ttl time.Duration, reqBuilder LockRequestBuilder) (string, time.Time, error) {
+func tryLock(ctx context.Context, s table.Session, lockName string, owner string, ttl time.Duration, reqBuilder LockRequestBuilder) (string, time.Time, uint64, error) {
 	query, params := reqBuilder.GetUpdateLockQueryWithParams(lockName, owner, ttl)
 	_, res, err := s.Execute(ctx, table.DefaultTxControl(), query, params)
 	if err != nil {
-		return "", time.Time{}, fmt.Errorf("execute error: %w", err)
+		return "", time.Time{}, 0, fmt.Errorf("execute error: %w", err)
 	}
 	defer res.Close()
 	if err = res.NextResultSetErr(ctx); err != nil {
-		return "", time.Time{}, fmt.Errorf("next result set error: %w", err)
+		return "", time.Time{}, 0, fmt.Errorf("next result set error: %w", err)
 	}
 	if !res.NextRow() {
-		return "", time.Time{}, fmt.Errorf("no rows in result: %w", err)
+		return "", time.Time{}, 0, ErrLockNotFound
 	}
 	var newOwner string
 	var newDeadline time.Time
-	err = res.ScanNamed(
+	var newGeneration uint64
+	values := []named.Value{
 		named.OptionalWithDefault(reqBuilder.GetOwnerColumnName(), &newOwner),
 		named.OptionalWithDefault(reqBuilder.GetDeadlineColumnName(), &newDeadline),
-	)
+	}
+	values = withOptionalColumn(values, reqBuilder.GetGenerationColumnName(), &newGeneration)
+	err = res.ScanNamed(values...)
 	if err != nil {
-		return "", time.Time{}, fmt.Errorf("scan error: %w", err)
+		return "", time.Time{}, 0, fmt.Errorf("scan error: %w", err)
 	}
-	return newOwner, newDeadline, nil
+	return newOwner, newDeadline, newGeneration, nil
 }
 
-func TryLock(ctx context.Context, c table.Client, lockName string, ownerName string, ttl time.Duration, reqBuilder LockRequestBuilder) (string, time.Time, error) {
+func TryLock(ctx context.Context, c table.Client, lockName string, ownerName string, ttl time.Duration, reqBuilder LockRequestBuilder, opts ...table.Option) (string, time.Time, uint64, error) {
 	var curOwner string
 	var curTimeout time.Time
+	var curGeneration uint64
 
 	err := c.Do(ctx, func(ctx context.Context, s table.Session) error {
 		var err error
-		curOwner, curTimeout, err = tryLock(ctx, s, lockName, ownerName, ttl, reqBuilder)
+		curOwner, curTimeout, curGeneration, err = tryLock(ctx, s, lockName, ownerName, ttl, reqBuilder)
 		if err != nil {
 			return err
 		}
 		return nil
-	})
+	}, opts...)
 	if err != nil {
-		return "", time.Time{}, err
+		return "", time.Time{}, 0, schemeError(err)
+	}
+	return curOwner, curTimeout, curGeneration, nil
+}
+
+func ReleaseLock(ctx context.Context, c table.Client, lockName string, ownerName string, reqBuilder LockRequestBuilder, opts ...table.Option) (bool, error) {
+	query, params := reqBuilder.GetReleaseLockQueryWithParams(lockName, ownerName)
+	released, err := execFlagQuery(ctx, c, query, params, "released", opts...)
+	return released, schemeError(err)
+}
+
+func SetLockMetadata(ctx context.Context, c table.Client, lockName string, ownerName string, metadata []byte, reqBuilder LockRequestBuilder, opts ...table.Option) (bool, error) {
+	if reqBuilder.GetMetadataColumnName() == "" {
+		return false, ErrNoMetadataColumn
 	}
-	return curOwner, curTimeout, nil
+	query, params := reqBuilder.GetSetMetadataQueryWithParams(lockName, ownerName, metadata)
+	updated, err := execFlagQuery(ctx, c, query, params, "updated", opts...)
+	return updated, schemeError(err)
 }
 
-func CreateLock(ctx context.Context, c table.Client, lockName string, reqBuilder LockRequestBuilder) (created bool, err error) {
+func CreateLock(ctx context.Context, c table.Client, lockName string, reqBuilder LockRequestBuilder, opts ...table.Option) (created bool, err error) {
 	query, params := reqBuilder.GetCreateLockQueryWithParams(lockName)
 
 	err = c.Do(ctx, func(ctx context.Context, s table.Session) error {
 		_, _, err := s.Execute(ctx, table.DefaultTxControl(), query, params)
 		if err == nil {
 			created = true
-		} else if ydb.IsOperationError(err, Ydb.StatusIds_PRECONDITION_FAILED) {
-			if strings.Contains(err.Error(), "Conflict with existing key") {
-				return nil
-			}
+		} else if ClassifyError(err) == ErrorClassPreconditionFailed {
+			// The lock row is inserted, so the only precondition that can fail is the existing key.
+			return nil
 		}
 
 		return err
+	}, opts...)
+
+	return created, schemeError(err)
+}
+
+// ExecuteGuarded runs query in a transaction of its own, guarded with GetGuardedQueryWithParams: it is a single
+// round trip that fails with ErrLockGuard and writes nothing unless owner holds the lock.
+func ExecuteGuarded(ctx context.Context, c table.Client, lockName string, owner string, generation uint64, query string, params *table.QueryParameters, reqBuilder LockRequestBuilder) error {
+	query, params = reqBuilder.GetGuardedQueryWithParams(lockName, owner, generation, query, params)
+	err := c.Do(ctx, func(ctx context.Context, s table.Session) error {
+		_, res, err := s.Execute(ctx, table.DefaultTxControl(), query, params)
+		if err != nil {
+			return fmt.Errorf("execute error: %w", err)
+		}
+		return res.Close()
+	})
+	return guardError(schemeError(err))
+}
+
+// guardError marks errors caused by a failed lock guard with ErrLockGuard.
+func guardError(err error) error {
+	guardFailed := false
+	ydb.IterateByIssues(err, func(message string, _ Ydb.StatusIds_StatusCode, _ uint32) {
+		guardFailed = guardFailed || strings.Contains(message, LockGuardMessage)
+	})
+	if guardFailed {
+		return fmt.Errorf("%w: %w", ErrLockGuard, err)
+	}
+	return err
+}
+
+// withOptionalColumn adds a column the builder may leave out of the locks table to the scanned ones,
+// the destination keeps its zero value if the column name is empty.
+func withOptionalColumn(values []named.Value, columnName string, destination interface{}) []named.Value {
+	if columnName == "" {
+		return values
+	}
+	return append(values, named.OptionalWithDefault(columnName, destination))
+}
+
+// schemeError marks errors caused by a missing table or column with ErrTableMissing.
+func schemeError(err error) error {
+	if err != nil && ydb.IsOperationErrorSchemeError(err) {
+		return fmt.Errorf("%w: %w", ErrTableMissing, err)
+	}
+	return err
+}
+
+// acquireHolder executes a query whose only result set is (acquired, <deadline column>).
+func acquireHolder(ctx context.Context, c table.Client, query string, params *table.QueryParameters, deadlineColumnName string) (bool, time.Time, error) {
+	var acquired bool
+	var deadline time.Time
+
+	err := c.Do(ctx, func(ctx context.Context, s table.Session) error {
+		_, res, err := s.Execute(ctx, table.DefaultTxControl(), query, params)
+		if err != nil {
+			return fmt.Errorf("execute error: %w", err)
+		}
+		defer res.Close()
+		if err = res.NextResultSetErr(ctx); err != nil {
+			return fmt.Errorf("next result set error: %w", err)
+		}
+		if !res.NextRow() {
+			return fmt.Errorf("%w: no rows in result", ErrUnexpectedResult)
+		}
+		err = res.ScanNamed(
+			named.Required("acquired", &acquired),
+			named.Required(deadlineColumnName, &deadline),
+		)
+		if err != nil {
+			return fmt.Errorf("scan error: %w", err)
+		}
+		return nil
 	})
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	return acquired, deadline, nil
+}
+
+// execFlagQuery executes a query whose first result set is a single boolean column, e.g. (released).
+// The lock queries select it from the lock row, so an empty result set is ErrLockNotFound.
+func execFlagQuery(ctx context.Context, c table.Client, query string, params *table.QueryParameters, flagColumnName string, opts ...table.Option) (bool, error) {
+	var flag bool
 
-	return
+	err := c.Do(ctx, func(ctx context.Context, s table.Session) error {
+		_, res, err := s.Execute(ctx, table.DefaultTxControl(), query, params)
+		if err != nil {
+			return fmt.Errorf("execute error: %w", err)
+		}
+		defer res.Close()
+		if err = res.NextResultSetErr(ctx); err != nil {
+			return fmt.Errorf("next result set error: %w", err)
+		}
+		if !res.NextRow() {
+			return ErrLockNotFound
+		}
+		if err = res.ScanNamed(named.Required(flagColumnName, &flag)); err != nil {
+			return fmt.Errorf("scan error: %w", err)
+		}
+		return nil
+	}, opts...)
+	if err != nil {
+		return false, err
+	}
+	return flag, nil
 }
 
+// CreateLocksTable creates the locks table. An existing table is kept, but if reqBuilder implements
+// LockSchemaMigrationRequestBuilder the columns it lacks are added.
 func CreateLocksTable(ctx context.Context, c scripting.Client, reqBuilder LockSchemaRequestBuilder) error {
 	q := reqBuilder.GetCreateLocksTableQuery()
-	_, err := c.Execute(ctx, q, nil)
-	return err
+	if _, err := c.Execute(ctx, q, nil); err != nil {
+		return err
+	}
+	migrationBuilder, ok := reqBuilder.(LockSchemaMigrationRequestBuilder)
+	if !ok {
+		return nil
+	}
+	for _, migration := range migrationBuilder.GetLocksTableMigrations() {
+		if _, err := c.Execute(ctx, migration.CheckQuery, nil); err == nil {
+			continue
+		}
+		if _, err := c.Execute(ctx, migration.AddQuery, nil); err != nil {
+			return fmt.Errorf("add column error: %w", err)
+		}
+	}
+	return nil
 }
@@ -2,11 +2,14 @@ package ydb_locker
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/ydb-platform/ydb-go-sdk/v3"
 	"github.com/ydb-platform/ydb-go-sdk/v3/scripting"
 	"github.com/ydb-platform/ydb-go-sdk/v3/sugar"
 	"github.com/ydb-platform/ydb-go-sdk/v3/table"
+	"github.com/ydb-platform/ydb-go-sdk/v3/table/types"
+	"strings"
 	"testing"
 	"time"
 )
@@ -29,7 +32,7 @@ func DropTableIfExists(t *testing.T, ctx context.Context, c scripting.Client, ta
 
 func simpleTryLockCheck(t *testing.T, ctx context.Context, db *ydb.Driver, lockName string, ownerName string, reqBuilder LockRequestBuilder) {
 	ttl := 10 * time.Second
-	_, _, err := TryLock(ctx, db.Table(), lockName, ownerName, ttl, reqBuilder)
+	_, _, _, err := TryLock(ctx, db.Table(), lockName, ownerName, ttl, reqBuilder)
 	if err != nil {
 		t.Fatal("try lock error", err)
 	}
@@ -100,5 +103,287 @@ func TestAcquireLockWithExistingTable(t *testing.T) {
 	}
 
 	simpleTryLockCheck(t, ctx, db, "lock1", "owner1", reqBuilder)
+	if _, err := SetLockMetadata(ctx, db.Table(), "lock1", "owner1", []byte("addr"), reqBuilder); !errors.Is(err, ErrNoMetadataColumn) {
+		t.Errorf("expected ErrNoMetadataColumn, got %v", err)
+	}
+}
+
+func TestCreateLocksTableAddsColumns(t *testing.T) {
+	ctx := context.Background()
+	db := ConnectToDb(t, ctx)
+	tableName := "TestCreateLocksTableAddsColumns"
+	reqBuilder := GetDefaultRequestBuilder(tableName)
+
+	// The table as created before the generation and metadata columns.
+	DropTableIfExists(t, ctx, db.Scripting(), tableName)
+	_, err := db.Scripting().Execute(ctx, fmt.Sprintf(`
+		CREATE TABLE %[1]s (
+		    %[2]s utf8, %[3]s utf8, %[4]s timestamp,
+			primary key (%[2]s)
+		)
+	`, tableName, reqBuilder.LockNameColumnName, reqBuilder.OwnerColumnName, reqBuilder.DeadlineColumnName), nil)
+	if err != nil {
+		t.Fatal("create table error", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := CreateLocksTable(ctx, db.Scripting(), reqBuilder); err != nil {
+			t.Fatal("create table error", err)
+		}
+	}
+	if _, err := CreateLock(ctx, db.Table(), "lock1", reqBuilder); err != nil {
+		t.Fatal("create lock error", err)
+	}
+	simpleTryLockCheck(t, ctx, db, "lock1", "owner1", reqBuilder)
+	if _, err := SetLockMetadata(ctx, db.Table(), "lock1", "owner1", []byte("addr"), reqBuilder); err != nil {
+		t.Error("set metadata error", err)
+	}
+}
+
+func TestReleaseLock(t *testing.T) {
+	ctx := context.Background()
+	db := ConnectToDb(t, ctx)
+	reqBuilder := GetDefaultRequestBuilder("TestReleaseLock")
+
+	DropTableIfExists(t, ctx, db.Scripting(), reqBuilder.TableName)
+	if err := CreateLocksTable(ctx, db.Scripting(), reqBuilder); err != nil {
+		t.Fatal("create table error", err)
+	}
+	if _, err := CreateLock(ctx, db.Table(), "lock1", reqBuilder); err != nil {
+		t.Fatal("create lock error", err)
+	}
+
+	simpleTryLockCheck(t, ctx, db, "lock1", "owner1", reqBuilder)
+
+	released, err := ReleaseLock(ctx, db.Table(), "lock1", "owner2", reqBuilder)
+	if err != nil {
+		t.Fatal("release lock error", err)
+	}
+	if released {
+		t.Error("release by non-owner succeeded")
+	}
 
+	released, err = ReleaseLock(ctx, db.Table(), "lock1", "owner1", reqBuilder)
+	if err != nil {
+		t.Fatal("release lock error", err)
+	}
+	if !released {
+		t.Error("release by owner failed")
+	}
+
+	simpleTryLockCheck(t, ctx, db, "lock1", "owner2", reqBuilder)
+}
+
+func TestLockMetadata(t *testing.T) {
+	ctx := context.Background()
+	db := ConnectToDb(t, ctx)
+	reqBuilder := GetDefaultRequestBuilder("TestLockMetadata")
+
+	DropTableIfExists(t, ctx, db.Scripting(), reqBuilder.TableName)
+	if err := CreateLocksTable(ctx, db.Scripting(), reqBuilder); err != nil {
+		t.Fatal("create table error", err)
+	}
+	if _, err := CreateLock(ctx, db.Table(), "lock1", reqBuilder); err != nil {
+		t.Fatal("create lock error", err)
+	}
+	simpleTryLockCheck(t, ctx, db, "lock1", "owner1", reqBuilder)
+
+	updated, err := SetLockMetadata(ctx, db.Table(), "lock1", "owner1", []byte("host1:80"), reqBuilder)
+	if err != nil || !updated {
+		t.Fatal("set metadata error", updated, err)
+	}
+	updated, err = SetLockMetadata(ctx, db.Table(), "lock1", "owner2", []byte("host2:80"), reqBuilder)
+	if err != nil || updated {
+		t.Fatal("non-owner set metadata", updated, err)
+	}
+
+	info, err := GetLock(ctx, db.Table(), "lock1", reqBuilder)
+	if err != nil {
+		t.Fatal("get lock error", err)
+	}
+	if info.Owner != "owner1" || string(info.Metadata) != "host1:80" || !info.Alive {
+		t.Errorf("unexpected lock info: %+v", info)
+	}
+
+	if _, err := ReleaseLock(ctx, db.Table(), "lock1", "owner1", reqBuilder); err != nil {
+		t.Fatal("release lock error", err)
+	}
+	if info, _ := GetLock(ctx, db.Table(), "lock1", reqBuilder); info.Metadata != nil {
+		t.Errorf("metadata was not cleared on release: %s", info.Metadata)
+	}
+}
+
+func TestLockErrors(t *testing.T) {
+	ctx := context.Background()
+	db := ConnectToDb(t, ctx)
+	tableName := "TestLockErrors"
+	reqBuilder := GetDefaultRequestBuilder(tableName)
+
+	DropTableIfExists(t, ctx, db.Scripting(), tableName)
+	if _, _, _, err := TryLock(ctx, db.Table(), "lock1", "owner1", time.Second*10, reqBuilder); !errors.Is(err, ErrTableMissing) {
+		t.Fatalf("expected ErrTableMissing, got %v", err)
+	}
+
+	if err := CreateLocksTable(ctx, db.Scripting(), reqBuilder); err != nil {
+		t.Fatal("create table error", err)
+	}
+	if _, _, _, err := TryLock(ctx, db.Table(), "lock1", "owner1", time.Second*10, reqBuilder); !errors.Is(err, ErrLockNotFound) {
+		t.Errorf("expected ErrLockNotFound from TryLock, got %v", err)
+	}
+	if _, err := GetLock(ctx, db.Table(), "lock1", reqBuilder); !errors.Is(err, ErrLockNotFound) {
+		t.Errorf("expected ErrLockNotFound from GetLock, got %v", err)
+	}
+	if _, err := ReleaseLock(ctx, db.Table(), "lock1", "owner1", reqBuilder); !errors.Is(err, ErrLockNotFound) {
+		t.Errorf("expected ErrLockNotFound from ReleaseLock, got %v", err)
+	}
+	if _, err := SetLockMetadata(ctx, db.Table(), "lock1", "owner1", []byte("host1:80"), reqBuilder); !errors.Is(err, ErrLockNotFound) {
+		t.Errorf("expected ErrLockNotFound from SetLockMetadata, got %v", err)
+	}
+
+	if _, err := CreateLock(ctx, db.Table(), "lock1", reqBuilder); err != nil {
+		t.Fatal("create lock error", err)
+	}
+	if _, _, _, err := TryLock(ctx, db.Table(), "lock1", "owner1", time.Second*10, reqBuilder); err != nil {
+		t.Fatal("try lock error", err)
+	}
+	storage := &YdbLockStorage{Db: db, ReqBuilder: reqBuilder}
+	err := storage.ExecuteUnderLock(ctx, "lock1", "owner2", func(context.Context, table.Session, table.Transaction) error {
+		return nil
+	})
+	if !errors.Is(err, ErrNotOwner) {
+		t.Errorf("expected ErrNotOwner, got %v", err)
+	}
+
+	if _, _, _, err := TryLock(ctx, db.Table(), "lock1", "owner1", time.Millisecond*100, reqBuilder); err != nil {
+		t.Fatal("try lock error", err)
+	}
+	time.Sleep(time.Millisecond * 200)
+	err = storage.ExecuteUnderLock(ctx, "lock1", "owner1", func(context.Context, table.Session, table.Transaction) error {
+		return nil
+	})
+	if !errors.Is(err, ErrLockExpired) {
+		t.Errorf("expected ErrLockExpired, got %v", err)
+	}
+}
+
+func TestExecuteUnderLockAutoCommit(t *testing.T) {
+	ctx := context.Background()
+	db := ConnectToDb(t, ctx)
+	tableName := "TestExecuteUnderLockAutoCommit"
+	reqBuilder := GetDefaultRequestBuilder(tableName)
+
+	DropTableIfExists(t, ctx, db.Scripting(), tableName)
+	if err := CreateLocksTable(ctx, db.Scripting(), reqBuilder); err != nil {
+		t.Fatal("create table error", err)
+	}
+	if _, err := CreateLock(ctx, db.Table(), "lock1", reqBuilder); err != nil {
+		t.Fatal("create lock error", err)
+	}
+	if _, _, _, err := TryLock(ctx, db.Table(), "lock1", "owner1", time.Second*10, reqBuilder); err != nil {
+		t.Fatal("try lock error", err)
+	}
+	storage := &YdbLockStorage{Db: db, ReqBuilder: reqBuilder}
+
+	insert := func(lockName string, fail error) func(context.Context, table.Session, table.Transaction) error {
+		return func(ctx context.Context, ts table.Session, tx table.Transaction) error {
+			query := fmt.Sprintf("DECLARE $LOCK_NAME AS Utf8; UPSERT INTO %s (lock_name, owner) VALUES ($LOCK_NAME, 'x'u)", tableName)
+			_, err := tx.Execute(ctx, query, table.NewQueryParameters(table.ValueParam("$LOCK_NAME", types.UTF8Value(lockName))))
+			if err != nil {
+				return err
+			}
+			return fail
+		}
+	}
+	if err := storage.ExecuteUnderLock(ctx, "lock1", "owner1", insert("lock2", nil), WithAutoCommit()); err != nil {
+		t.Fatal("execute under lock error", err)
+	}
+	if info, err := GetLock(ctx, db.Table(), "lock2", reqBuilder); err != nil || info.Owner != "x" {
+		t.Errorf("expected a committed row, got %v %v", info, err)
+	}
+
+	userErr := errors.New("user error")
+	if err := storage.ExecuteUnderLock(ctx, "lock1", "owner1", insert("lock3", userErr), WithAutoCommit()); !errors.Is(err, userErr) {
+		t.Errorf("expected the user error, got %v", err)
+	}
+	if _, err := GetLock(ctx, db.Table(), "lock3", reqBuilder); !errors.Is(err, ErrLockNotFound) {
+		t.Errorf("expected a rolled back row, got %v", err)
+	}
+
+	err := storage.ExecuteUnderLock(ctx, "lock1", "owner1", func(ctx context.Context, ts table.Session, tx table.Transaction) error {
+		if tx != nil {
+			t.Error("expected no transaction in online read-only mode")
+		}
+		return nil
+	}, WithTxMode(TxOnlineReadOnly))
+	if err != nil {
+		t.Error("execute under lock error", err)
+	}
+}
+
+func TestExecuteGuarded(t *testing.T) {
+	ctx := context.Background()
+	db := ConnectToDb(t, ctx)
+	tableName := "TestExecuteGuarded"
+	reqBuilder := GetDefaultRequestBuilder(tableName)
+
+	DropTableIfExists(t, ctx, db.Scripting(), tableName)
+	if err := CreateLocksTable(ctx, db.Scripting(), reqBuilder); err != nil {
+		t.Fatal("create table error", err)
+	}
+	if _, err := CreateLock(ctx, db.Table(), "lock1", reqBuilder); err != nil {
+		t.Fatal("create lock error", err)
+	}
+	_, _, generation, err := TryLock(ctx, db.Table(), "lock1", "owner1", time.Second*10, reqBuilder)
+	if err != nil {
+		t.Fatal("try lock error", err)
+	}
+	storage := &YdbLockStorage{Db: db, ReqBuilder: reqBuilder}
+
+	query := fmt.Sprintf("DECLARE $LOCK_NAME AS Utf8; UPSERT INTO %s (lock_name, owner) VALUES ($LOCK_NAME, 'x'u);", tableName)
+	params := func(lockName string) *table.QueryParameters {
+		return table.NewQueryParameters(table.ValueParam("$LOCK_NAME", types.UTF8Value(lockName)))
+	}
+	if err := storage.ExecuteGuarded(ctx, "lock1", "owner1", query, params("lock2")); err != nil {
+		t.Fatal("guarded query error", err)
+	}
+	if _, err := GetLock(ctx, db.Table(), "lock2", reqBuilder); err != nil {
+		t.Errorf("expected the guarded write to be committed, got %v", err)
+	}
+
+	if err := storage.ExecuteGuarded(ctx, "lock1", "owner2", query, params("lock3")); !errors.Is(err, ErrLockGuard) {
+		t.Errorf("expected ErrLockGuard, got %v", err)
+	}
+	if err := ExecuteGuarded(ctx, db.Table(), "lock1", "owner1", generation+1, query, params("lock3"), reqBuilder); !errors.Is(err, ErrLockGuard) {
+		t.Errorf("expected ErrLockGuard for a stale generation, got %v", err)
+	}
+	if _, err := GetLock(ctx, db.Table(), "lock3", reqBuilder); !errors.Is(err, ErrLockNotFound) {
+		t.Errorf("expected the guarded write to be aborted, got %v", err)
+	}
+}
+
+func TestRequestBuilderOptionalColumns(t *testing.T) {
+	reqBuilder := GetDefaultRequestBuilder("locks")
+	reqBuilder.GenerationColumnName = ""
+	reqBuilder.MetadataColumnName = ""
+
+	queries := map[string]string{
+		"create table": reqBuilder.GetCreateLocksTableQuery(),
+	}
+	queries["select"], _ = reqBuilder.GetSelectLockQueryWithParams("lock1")
+	queries["check lease"], _ = reqBuilder.GetCheckLeaseQueryWithParams("lock1")
+	queries["update"], _ = reqBuilder.GetUpdateLockQueryWithParams("lock1", "owner1", time.Second)
+	queries["create"], _ = reqBuilder.GetCreateLockQueryWithParams("lock1")
+	queries["release"], _ = reqBuilder.GetReleaseLockQueryWithParams("lock1", "owner1")
+	queries["guarded"], _ = reqBuilder.GetGuardedQueryWithParams("lock1", "owner1", 1, "SELECT 1", nil)
+	for name, query := range queries {
+		if strings.Contains(query, "generation") || strings.Contains(query, "metadata") {
+			t.Errorf("%s query uses an optional column:\n%s", name, query)
+		}
+	}
+	if migrations := reqBuilder.GetLocksTableMigrations(); len(migrations) != 0 {
+		t.Errorf("expected no migrations without optional columns, got %v", migrations)
+	}
+	if migrations := GetDefaultRequestBuilder("locks").GetLocksTableMigrations(); len(migrations) != 2 {
+		t.Errorf("expected generation and metadata migrations, got %v", migrations)
+	}
 }